@@ -0,0 +1,156 @@
+package ocicni
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+)
+
+const (
+	// IngressBandwidthAnnotation is the pod annotation which limits the
+	// ingress bandwidth of a pod, like "10M".
+	IngressBandwidthAnnotation = "kubernetes.io/ingress-bandwidth"
+	// EgressBandwidthAnnotation is the pod annotation which limits the
+	// egress bandwidth of a pod, like "10M".
+	EgressBandwidthAnnotation = "kubernetes.io/egress-bandwidth"
+
+	// maxBandwidth is the largest bandwidth limit accepted, in bits per
+	// second.
+	maxBandwidth = 32 * 1000 * 1000 * 1000
+
+	// defaultBandwidthBurst is the burst used for bandwidth limits, which
+	// effectively does not limit bursts.
+	defaultBandwidthBurst = math.MaxUint32
+)
+
+// quantityRegexp matches Kubernetes resource quantities without sign: a
+// decimal number with an optional binary SI, decimal SI or decimal exponent
+// suffix.
+var quantityRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]*)?|\.[0-9]+)(Ki|Mi|Gi|Ti|Pi|Ei|m|k|M|G|T|P|E|[eE][+-]?[0-9]+)?$`)
+
+// quantityMultiplier returns the multiplier of a resource quantity suffix.
+func quantityMultiplier(suffix string) (*big.Rat, error) {
+	const (
+		decimalBase = 10
+		maxExponent = 18
+	)
+
+	binaryExponents := map[string]int64{"Ki": 10, "Mi": 20, "Gi": 30, "Ti": 40, "Pi": 50, "Ei": 60}
+	decimalExponents := map[string]int64{"": 0, "m": -3, "k": 3, "M": 6, "G": 9, "T": 12, "P": 15, "E": 18}
+
+	if exponent, ok := binaryExponents[suffix]; ok {
+		return new(big.Rat).SetInt(new(big.Int).Lsh(big.NewInt(1), uint(exponent))), nil
+	}
+
+	exponent, ok := decimalExponents[suffix]
+	if !ok {
+		// Decimal exponent like "e6"
+		var err error
+
+		exponent, err = strconv.ParseInt(suffix[1:], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		if absInt64(exponent) > maxExponent {
+			return nil, fmt.Errorf("exponent %d out of range", exponent)
+		}
+	}
+
+	power := new(big.Int).Exp(big.NewInt(decimalBase), big.NewInt(absInt64(exponent)), nil)
+	if exponent < 0 {
+		return new(big.Rat).SetFrac(big.NewInt(1), power), nil
+	}
+
+	return new(big.Rat).SetInt(power), nil
+}
+
+func absInt64(value int64) int64 {
+	if value < 0 {
+		return -value
+	}
+
+	return value
+}
+
+// ParseBandwidth parses a bandwidth limit in bits per second given as a
+// Kubernetes resource quantity, like "10M" or "1Gi". Fractional values are
+// rounded up. Limits of zero or above 32Gbps are rejected.
+func ParseBandwidth(quantity string) (uint64, error) {
+	match := quantityRegexp.FindStringSubmatch(quantity)
+	if match == nil {
+		return 0, fmt.Errorf("invalid bandwidth quantity %q", quantity)
+	}
+
+	number, ok := new(big.Rat).SetString(match[1])
+	if !ok {
+		return 0, fmt.Errorf("invalid bandwidth quantity %q", quantity)
+	}
+
+	multiplier, err := quantityMultiplier(match[2])
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth quantity %q: %w", quantity, err)
+	}
+
+	value := number.Mul(number, multiplier)
+
+	if value.Sign() <= 0 {
+		return 0, fmt.Errorf("bandwidth %q must be greater than zero", quantity)
+	}
+
+	if value.Cmp(new(big.Rat).SetInt64(maxBandwidth)) > 0 {
+		return 0, fmt.Errorf("bandwidth %q is above the maximum of 32Gbps", quantity)
+	}
+
+	// Round up to whole bits per second
+	rate, remainder := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	if remainder.Sign() != 0 {
+		rate.Add(rate, big.NewInt(1))
+	}
+
+	return rate.Uint64(), nil
+}
+
+// NewBandwidthConfig returns the bandwidth configuration for ingress and
+// egress limits given as Kubernetes resource quantities, see ParseBandwidth.
+// An empty limit does not limit the bandwidth in that direction. The burst
+// sizes are set to a value which does not limit bursts. It returns nil if
+// both limits are empty.
+func NewBandwidthConfig(ingress, egress string) (*BandwidthConfig, error) {
+	if ingress == "" && egress == "" {
+		return nil, nil //nolint:nilnil // no limits is not an error
+	}
+
+	config := &BandwidthConfig{}
+
+	if ingress != "" {
+		rate, err := ParseBandwidth(ingress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ingress bandwidth: %w", err)
+		}
+
+		config.IngressRate = rate
+		config.IngressBurst = defaultBandwidthBurst
+	}
+
+	if egress != "" {
+		rate, err := ParseBandwidth(egress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid egress bandwidth: %w", err)
+		}
+
+		config.EgressRate = rate
+		config.EgressBurst = defaultBandwidthBurst
+	}
+
+	return config, nil
+}
+
+// BandwidthConfigFromAnnotations returns the bandwidth configuration for the
+// IngressBandwidthAnnotation and EgressBandwidthAnnotation annotations of a
+// pod, see NewBandwidthConfig. It returns nil if neither is set.
+func BandwidthConfigFromAnnotations(annotations map[string]string) (*BandwidthConfig, error) {
+	return NewBandwidthConfig(annotations[IngressBandwidthAnnotation], annotations[EgressBandwidthAnnotation])
+}
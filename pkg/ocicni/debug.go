@@ -0,0 +1,174 @@
+package ocicni
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	cniinvoke "github.com/containernetworking/cni/pkg/invoke"
+)
+
+// Operation is a CNI operation run on behalf of a pod.
+type Operation string
+
+const (
+	// OperationAdd attaches a pod to its networks.
+	OperationAdd Operation = "ADD"
+	// OperationDel detaches a pod from its networks.
+	OperationDel Operation = "DEL"
+	// OperationCheck checks the networks of a pod.
+	OperationCheck Operation = "CHECK"
+)
+
+// InFlightOperation describes a pod which currently holds or waits for its
+// pod lock.
+type InFlightOperation struct {
+	// PodKey is the key of the pod in the pod map, "<namespace>_<name>".
+	PodKey string
+	// Refcount is the number of operations holding or waiting for the
+	// pod lock.
+	Refcount uint
+	// Operation is the operation holding the pod lock, empty if the lock
+	// is not held yet.
+	Operation Operation
+	// Network is the name of the network currently being processed.
+	Network string
+	// Plugin is the path of the plugin binary currently executing.
+	Plugin string
+	// Started is the time at which the operation acquired the pod lock.
+	Started time.Time
+}
+
+// DebugInfo is a snapshot of the internal lock state of the plugin.
+type DebugInfo struct {
+	// InFlight contains all pods in the pod map, sorted by pod key.
+	InFlight []InFlightOperation
+	// GCRunning is true if GC holds the GC lock.
+	GCRunning bool
+}
+
+// podOperation is the operation currently holding a pod lock.
+type podOperation struct {
+	mu sync.Mutex
+
+	operation Operation
+	network   string
+	plugin    string
+	started   time.Time
+}
+
+type podOperationKey struct{}
+
+func (op *podOperation) start(operation Operation) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.operation = operation
+	op.started = time.Now()
+}
+
+func (op *podOperation) reset() {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.operation = ""
+	op.network = ""
+	op.plugin = ""
+	op.started = time.Time{}
+}
+
+func (op *podOperation) setNetwork(network string) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.network = network
+}
+
+func (op *podOperation) setPlugin(plugin string) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.plugin = plugin
+}
+
+func (op *podOperation) fill(info *InFlightOperation) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	info.Operation = op.operation
+	info.Network = op.network
+	info.Plugin = op.plugin
+	info.Started = op.started
+}
+
+// withPodOperation returns a context which carries the operation of a pod
+// lock, so that the network and plugin being processed can be recorded.
+func withPodOperation(ctx context.Context, op *podOperation) context.Context {
+	return context.WithValue(ctx, podOperationKey{}, op)
+}
+
+func podOperationFromContext(ctx context.Context) *podOperation {
+	op, _ := ctx.Value(podOperationKey{}).(*podOperation)
+
+	return op
+}
+
+// setOperationNetwork records the network being processed by the pod
+// operation carried by ctx, if any.
+func setOperationNetwork(ctx context.Context, network string) {
+	if op := podOperationFromContext(ctx); op != nil {
+		op.setNetwork(network)
+	}
+}
+
+// trackingExec records the plugin binary which is executed on behalf of a
+// pod operation.
+type trackingExec struct {
+	cniinvoke.Exec
+}
+
+func (e *trackingExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	if op := podOperationFromContext(ctx); op != nil {
+		op.setPlugin(pluginPath)
+		defer op.setPlugin("")
+	}
+
+	return e.Exec.ExecPlugin(ctx, pluginPath, stdinData, environ)
+}
+
+// InFlight returns all pods which currently hold or wait for their pod lock.
+func (plugin *cniNetworkPlugin) InFlight() []InFlightOperation {
+	inFlight := []InFlightOperation{}
+
+	for i := range plugin.podShards {
+		shard := &plugin.podShards[i]
+		shard.Lock()
+
+		for key, lock := range shard.pods {
+			info := InFlightOperation{
+				PodKey:   key,
+				Refcount: lock.refcount,
+			}
+			lock.op.fill(&info)
+			inFlight = append(inFlight, info)
+		}
+
+		shard.Unlock()
+	}
+
+	sort.Slice(inFlight, func(i, j int) bool {
+		return inFlight[i].PodKey < inFlight[j].PodKey
+	})
+
+	return inFlight
+}
+
+// Debug returns a snapshot of the in-flight pod operations and of the GC
+// lock.
+func (plugin *cniNetworkPlugin) Debug() DebugInfo {
+	return DebugInfo{
+		InFlight:  plugin.InFlight(),
+		GCRunning: plugin.gcRunning.Load(),
+	}
+}
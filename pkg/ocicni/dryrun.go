@@ -0,0 +1,219 @@
+package ocicni
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/containernetworking/cni/libcni"
+	cniinvoke "github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// DryRunInvocation is a single plugin invocation of a dry run.
+type DryRunInvocation struct {
+	// Plugin is the path of the plugin binary.
+	Plugin string
+	// Stdin is the network configuration which would be passed to the
+	// plugin on stdin, including the injected runtime config.
+	Stdin json.RawMessage
+	// Env contains the CNI_* environment variables of the invocation.
+	Env []string
+}
+
+// DryRunResult contains the plugin invocations of a dry run for a single
+// network attachment.
+type DryRunResult struct {
+	// NetAttachment contains the network and interface names of this
+	// network attachment
+	NetAttachment
+
+	// RuntimeConf is the runtime configuration built for the attachment
+	RuntimeConf *libcni.RuntimeConf
+
+	// Invocations are the plugin invocations in execution order
+	Invocations []DryRunInvocation
+}
+
+// recordingExec records plugin invocations instead of executing them. ADD
+// returns an empty result, so that chained plugins can be recorded as well;
+// their prevResult is therefore empty.
+type recordingExec struct {
+	cniinvoke.Exec
+
+	mu          sync.Mutex
+	invocations []DryRunInvocation
+}
+
+func (e *recordingExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	env := []string{}
+
+	var command string
+
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "CNI_") {
+			env = append(env, kv)
+		}
+
+		if value, ok := strings.CutPrefix(kv, "CNI_COMMAND="); ok {
+			command = value
+		}
+	}
+
+	if command == "VERSION" {
+		return e.Exec.ExecPlugin(ctx, pluginPath, stdinData, environ)
+	}
+
+	e.mu.Lock()
+	e.invocations = append(e.invocations, DryRunInvocation{
+		Plugin: pluginPath,
+		Stdin:  json.RawMessage(stdinData),
+		Env:    env,
+	})
+	e.mu.Unlock()
+
+	if command != "ADD" {
+		return nil, nil
+	}
+
+	conf := struct {
+		CNIVersion string `json:"cniVersion"`
+	}{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&conf)
+}
+
+// replayingExec returns a fixed result for ADD instead of executing the
+// plugins, so that libcni caches it.
+type replayingExec struct {
+	cniinvoke.Exec
+
+	result []byte
+}
+
+func (e *replayingExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	if slices.Contains(environ, "CNI_COMMAND=ADD") {
+		return e.result, nil
+	}
+
+	return e.Exec.ExecPlugin(ctx, pluginPath, stdinData, environ)
+}
+
+// dryRun runs the plugins of a single attachment with a recording exec and
+// a throwaway cache directory. If cachedResult is set, it is cached for the
+// attachment in the throwaway cache first, so that libcni passes it to the
+// plugins as their prevResult.
+func (plugin *cniNetworkPlugin) dryRun(ctx context.Context, network *cniNetwork, attachment *NetAttachment, rt *libcni.RuntimeConf, cachedResult types.Result, runFn func(*libcni.CNIConfig) error) (*DryRunResult, error) {
+	cacheDir, err := os.MkdirTemp("", "ocicni-dry-run")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(cacheDir)
+
+	if cachedResult != nil {
+		result, err := json.Marshal(cachedResult)
+		if err != nil {
+			return nil, err
+		}
+
+		replayer := &replayingExec{Exec: plugin.exec, result: result}
+		if _, err := libcni.NewCNIConfigWithCacheDir(plugin.binDirs, cacheDir, replayer).AddNetworkList(ctx, network.config, rt); err != nil {
+			return nil, fmt.Errorf("failed to cache result: %w", err)
+		}
+	}
+
+	recorder := &recordingExec{Exec: plugin.exec}
+	if err := runFn(libcni.NewCNIConfigWithCacheDir(plugin.binDirs, cacheDir, recorder)); err != nil {
+		return nil, err
+	}
+
+	return &DryRunResult{
+		NetAttachment: NetAttachment{
+			Name:    attachment.Name,
+			Ifname:  rt.IfName,
+			Primary: attachment.Primary,
+		},
+		RuntimeConf: rt,
+		Invocations: recorder.invocations,
+	}, nil
+}
+
+// SetUpPodDryRun resolves the networks of the pod like SetUpPod and returns
+// the plugin invocations SetUpPod would make, without executing any plugin
+// or touching the network namespace. Hooks are not called.
+//
+//nolint:gocritic // consistent with SetUpPod
+func (plugin *cniNetworkPlugin) SetUpPodDryRun(ctx context.Context, podNetwork PodNetwork) ([]DryRunResult, error) {
+	if err := plugin.networksAvailable(&podNetwork); err != nil {
+		return nil, err
+	}
+
+	if err := validateSysctls(podNetwork.Sysctls); err != nil {
+		return nil, err
+	}
+
+	results := make([]DryRunResult, 0)
+
+	if err := plugin.forEachNetwork(ctx, &podNetwork, false, func(network *cniNetwork, _ *PodNetwork, attachment *NetAttachment, rt *libcni.RuntimeConf) error {
+		result, err := plugin.dryRun(ctx, network, attachment, rt, nil, func(cni *libcni.CNIConfig) error {
+			_, err := network.addToNetwork(ctx, rt, cni)
+
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error in dry run of adding to CNI network %q: %w", network.name, err)
+		}
+
+		results = append(results, *result)
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// TearDownPodDryRun resolves the networks of the pod like TearDownPod and
+// returns the plugin invocations TearDownPod would make, without executing
+// any plugin or modifying the CNI cache. Hooks are not called.
+//
+//nolint:gocritic // consistent with TearDownPod
+func (plugin *cniNetworkPlugin) TearDownPodDryRun(ctx context.Context, podNetwork PodNetwork) ([]DryRunResult, error) {
+	plugin.fillCachedNetworks(&podNetwork)
+
+	if err := plugin.networksAvailable(&podNetwork); err != nil {
+		return nil, err
+	}
+
+	results := make([]DryRunResult, 0)
+
+	if err := plugin.forEachNetwork(ctx, &podNetwork, true, func(network *cniNetwork, _ *PodNetwork, attachment *NetAttachment, rt *libcni.RuntimeConf) error {
+		cachedResult, err := plugin.cniConfig.GetNetworkListCachedResult(network.config, rt)
+		if err != nil {
+			return fmt.Errorf("error in dry run of removing from CNI network %q: %w", network.name, err)
+		}
+
+		result, err := plugin.dryRun(ctx, network, attachment, rt, cachedResult, func(cni *libcni.CNIConfig) error {
+			return network.deleteFromNetwork(ctx, rt, cni)
+		})
+		if err != nil {
+			return fmt.Errorf("error in dry run of removing from CNI network %q: %w", network.name, err)
+		}
+
+		results = append(results, *result)
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
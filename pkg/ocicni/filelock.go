@@ -0,0 +1,104 @@
+package ocicni
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	lockDirName    = "locks"
+	gcLockFileName = "gc.lock"
+	lockFileSuffix = ".lock"
+)
+
+// fileLocker hands out flock-based locks which are shared between all
+// processes using the same lock directory.
+type fileLocker struct {
+	dir string
+}
+
+// fileLock is a held lock on a lock file.
+type fileLock struct {
+	file *os.File
+}
+
+func newFileLocker(cacheDir string) (*fileLocker, error) {
+	dir := filepath.Join(cacheDir, lockDirName)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory %q: %w", dir, err)
+	}
+
+	return &fileLocker{dir: dir}, nil
+}
+
+func (l *fileLocker) lock(name string, exclusive bool) (*fileLock, error) {
+	path := filepath.Join(l.dir, name)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %q: %w", path, err)
+	}
+
+	if err := lockFile(file, exclusive); err != nil {
+		file.Close()
+
+		return nil, fmt.Errorf("failed to lock %q: %w", path, err)
+	}
+
+	return &fileLock{file: file}, nil
+}
+
+// lockContainer exclusively locks the lock file of the given container.
+func (l *fileLocker) lockContainer(containerID string) (*fileLock, error) {
+	if err := utils.ValidateContainerID(containerID); err != nil {
+		return nil, fmt.Errorf("unable to lock container: %w", err)
+	}
+
+	return l.lock(containerID+lockFileSuffix, true)
+}
+
+// lockGC locks the GC lock file, exclusively for GC and shared for regular
+// pod operations.
+func (l *fileLocker) lockGC(exclusive bool) (*fileLock, error) {
+	return l.lock(gcLockFileName, exclusive)
+}
+
+// removeStale removes the lock files of all containers which are not part
+// of validIDs. The GC lock must be held exclusively, so that no other
+// process can hold or wait for a container lock.
+func (l *fileLocker) removeStale(validIDs map[string]bool) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		logrus.Warnf("Failed to read lock directory %s: %v", l.dir, err)
+
+		return
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if name == gcLockFileName || !strings.HasSuffix(name, lockFileSuffix) {
+			continue
+		}
+
+		if validIDs[strings.TrimSuffix(name, lockFileSuffix)] {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(l.dir, name)); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Failed to remove stale lock file %s: %v", name, err)
+		}
+	}
+}
+
+func (fl *fileLock) unlock() {
+	if err := unlockFile(fl.file); err != nil {
+		logrus.Errorf("Failed to unlock %s: %v", fl.file.Name(), err)
+	}
+
+	fl.file.Close()
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !freebsd
+
+package ocicni
+
+import (
+	"os"
+)
+
+func lockFile(_ *os.File, _ bool) error {
+	return errUnsupportedPlatform
+}
+
+func unlockFile(_ *os.File) error {
+	return errUnsupportedPlatform
+}
@@ -0,0 +1,216 @@
+package ocicni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/sirupsen/logrus"
+)
+
+// HealthCheckFailure is a failed check of a network attachment of a pod,
+// reported by the health check.
+type HealthCheckFailure struct {
+	// Pod is the pod of the attachment, with the namespace, name, ID and
+	// network namespace known from the CNI cache.
+	Pod PodNetwork
+	// Attachment is the failed network attachment.
+	Attachment NetAttachment
+	// Err is the error of the check.
+	Err error
+}
+
+// HealthCheckFunc is called for each failed check of the health check. It
+// may be called concurrently.
+type HealthCheckFunc func(failure *HealthCheckFailure)
+
+// healthCheckConfig configures the health check.
+type healthCheckConfig struct {
+	interval    time.Duration
+	concurrency int
+	onFailure   HealthCheckFunc
+}
+
+// WithHealthCheck periodically checks the network attachments of all pods
+// known from the CNI cache in the background, as GetPodNetworkStatus does,
+// and calls onFailure for each attachment whose check fails. At most
+// concurrency pods are checked at the same time. The health check stops on
+// Shutdown.
+func WithHealthCheck(interval time.Duration, concurrency int, onFailure HealthCheckFunc) Option {
+	return func(plugin *cniNetworkPlugin) error {
+		if interval <= 0 {
+			return fmt.Errorf("invalid health check interval %v", interval)
+		}
+
+		if concurrency <= 0 {
+			return fmt.Errorf("invalid health check concurrency %d", concurrency)
+		}
+
+		if onFailure == nil {
+			return errors.New("missing health check failure callback")
+		}
+
+		plugin.healthCheck = &healthCheckConfig{
+			interval:    interval,
+			concurrency: concurrency,
+			onFailure:   onFailure,
+		}
+
+		return nil
+	}
+}
+
+// listCachedPods returns the pods with network attachments in the CNI cache,
+// sorted by ID. Loopback attachments and attachments without network
+// namespace are ignored.
+func listCachedPods(cni *libcni.CNIConfig) ([]*PodNetwork, error) {
+	attachments, err := cni.GetCachedAttachments("")
+	if err != nil {
+		return nil, err
+	}
+
+	pods := map[string]*PodNetwork{}
+
+	for _, attachment := range attachments {
+		if attachment.Network == loopbackNetName || attachment.NetNS == "" {
+			continue
+		}
+
+		pod, ok := pods[attachment.ContainerID]
+		if !ok {
+			pod = &PodNetwork{ID: attachment.ContainerID, NetNS: attachment.NetNS}
+			pod.Namespace, pod.Name = podNameFromArgs(attachment.CniArgs)
+			pods[attachment.ContainerID] = pod
+		}
+
+		pod.Networks = append(pod.Networks, NetAttachment{Name: attachment.Network, Ifname: attachment.IfName})
+	}
+
+	list := make([]*PodNetwork, 0, len(pods))
+	for _, pod := range pods {
+		list = append(list, pod)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	return list, nil
+}
+
+// checkCachedPod checks the network attachments of a pod known from the CNI
+// cache and returns the failed ones. Attachments which were removed from the
+// cache since the pod was listed are skipped.
+func (plugin *cniNetworkPlugin) checkCachedPod(ctx context.Context, pod *PodNetwork) []HealthCheckFailure {
+	plugin.gcLock.RLock()
+	defer plugin.gcLock.RUnlock()
+
+	ctx = plugin.podLock(pod).startOperation(ctx, OperationCheck)
+	defer plugin.podUnlock(pod)
+
+	failures := []HealthCheckFailure{}
+
+	unlock, err := plugin.podFileLock(pod)
+	if err != nil {
+		for _, attachment := range pod.Networks {
+			failures = append(failures, HealthCheckFailure{Pod: *pod, Attachment: attachment, Err: err})
+		}
+
+		return failures
+	}
+	defer unlock()
+
+	for i := range pod.Networks {
+		attachment := &pod.Networks[i]
+
+		// Attachments removed since the pod was listed are skipped, and
+		// checks interrupted by Shutdown say nothing about the pod
+		err := plugin.checkCachedAttachment(ctx, pod, attachment)
+		if err != nil && !errors.Is(err, errNotCached) && ctx.Err() == nil {
+			failures = append(failures, HealthCheckFailure{Pod: *pod, Attachment: *attachment, Err: err})
+		}
+	}
+
+	return failures
+}
+
+// checkCachedAttachment checks a network attachment of a pod known from the
+// CNI cache.
+func (plugin *cniNetworkPlugin) checkCachedAttachment(ctx context.Context, pod *PodNetwork, attachment *NetAttachment) error {
+	network, rt, err := plugin.loadAttachmentFromCache(pod, attachment)
+	if err != nil {
+		return err
+	}
+
+	setOperationNetwork(ctx, attachment.Name)
+	_, err = plugin.checkAttachment(ctx, network, pod, attachment, rt)
+
+	return err
+}
+
+// runHealthCheck checks all pods known from the CNI cache once.
+func (plugin *cniNetworkPlugin) runHealthCheck(ctx context.Context) {
+	pods, err := listCachedPods(plugin.cniConfig)
+	if err != nil {
+		logrus.Warnf("Failed to list pods for the CNI health check: %v", err)
+
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	slots := make(chan struct{}, plugin.healthCheck.concurrency)
+
+	for _, pod := range pods {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+
+			return
+		}
+
+		wg.Go(func() {
+			defer func() { <-slots }()
+
+			failures := plugin.checkCachedPod(ctx, pod)
+			for i := range failures {
+				plugin.healthCheck.onFailure(&failures[i])
+			}
+		})
+	}
+
+	wg.Wait()
+}
+
+// healthCheckLoop runs the health check at its interval until Shutdown.
+func (plugin *cniNetworkPlugin) healthCheckLoop() {
+	defer plugin.done.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-plugin.shutdownChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(plugin.healthCheck.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			plugin.runHealthCheck(ctx)
+		}
+	}
+}
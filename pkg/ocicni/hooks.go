@@ -0,0 +1,67 @@
+package ocicni
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containernetworking/cni/libcni"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+)
+
+// HookEvent describes a single network operation of a pod, as passed to
+// hooks.
+type HookEvent struct {
+	// Operation is the CNI operation run for the attachment.
+	Operation Operation
+	// PodNetwork is the pod whose network is processed.
+	PodNetwork *PodNetwork
+	// Attachment is the network attachment which is processed.
+	Attachment *NetAttachment
+	// RuntimeConf is the runtime configuration passed to the plugins. Pre
+	// hooks may modify it.
+	RuntimeConf *libcni.RuntimeConf
+	// Result is the result of the operation. It is only set for post hooks
+	// of ADD and CHECK.
+	Result cnitypes.Result
+}
+
+// Hook is called before or after each network operation of a pod.
+//
+// A pre hook which returns an error vetoes the operation: the plugins are not
+// executed for the attachment and the error is returned. A post hook which
+// returns an error fails ADD and CHECK like a plugin error would; for DEL the
+// error is logged only, so that tear down always completes.
+type Hook func(ctx context.Context, event *HookEvent) error
+
+// WithPreHook registers a hook which is called before every network ADD, DEL
+// and CHECK. Hooks are called in the order in which they were registered.
+func WithPreHook(hook Hook) Option {
+	return func(plugin *cniNetworkPlugin) error {
+		plugin.preHooks = append(plugin.preHooks, hook)
+
+		return nil
+	}
+}
+
+// WithPostHook registers a hook which is called after every successful
+// network ADD, DEL and CHECK. Hooks are called in the order in which they
+// were registered.
+func WithPostHook(hook Hook) Option {
+	return func(plugin *cniNetworkPlugin) error {
+		plugin.postHooks = append(plugin.postHooks, hook)
+
+		return nil
+	}
+}
+
+// runHooks calls hooks in order, stopping at the first error. The phase is
+// "pre" or "post" and only used in errors.
+func runHooks(ctx context.Context, phase string, hooks []Hook, event *HookEvent) error {
+	for _, hook := range hooks {
+		if err := hook(ctx, event); err != nil {
+			return fmt.Errorf("%s-%s hook failed: %w", phase, event.Operation, err)
+		}
+	}
+
+	return nil
+}
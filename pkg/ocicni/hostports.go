@@ -0,0 +1,323 @@
+package ocicni
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/sirupsen/logrus"
+)
+
+// HostPortReservation is a host port reserved by a port mapping of a pod.
+type HostPortReservation struct {
+	// PortMapping is the port mapping reserving the host port.
+	PortMapping
+	// PodNamespace is the namespace of the pod owning the host port.
+	PodNamespace string
+	// PodName is the name of the pod owning the host port.
+	PodName string
+	// ContainerID is the ID of the sandbox container owning the host port.
+	ContainerID string
+	// Network is the network of the attachment with the port mapping.
+	Network string
+	// Ifname is the interface name of the attachment with the port mapping.
+	Ifname string
+}
+
+// HostPortConflictError is returned when a port mapping of a pod binds a
+// host port which is already reserved by another pod.
+type HostPortConflictError struct {
+	// PortMapping is the conflicting port mapping of the pod.
+	PortMapping PortMapping
+	// Owner is the reservation of the host port by the other pod.
+	Owner HostPortReservation
+}
+
+func (e *HostPortConflictError) Error() string {
+	return fmt.Sprintf("port mapping %s conflicts with port mapping %s of pod %s_%s (container %s)",
+		describePortMapping(&e.PortMapping), describePortMapping(&e.Owner.PortMapping),
+		e.Owner.PodNamespace, e.Owner.PodName, e.Owner.ContainerID)
+}
+
+// hostPortRegistry tracks the host ports reserved by the port mappings of
+// all pods set up by the plugin.
+type hostPortRegistry struct {
+	mu sync.Mutex
+
+	// reservations by container ID
+	pods map[string][]HostPortReservation
+}
+
+func newHostPortRegistry() *hostPortRegistry {
+	return &hostPortRegistry{pods: make(map[string][]HostPortReservation)}
+}
+
+// reserve adds the reservations of a container, unless one of them conflicts
+// with a reservation of another container. Reservations of the container for
+// the same attachments are replaced.
+func (r *hostPortRegistry) reserve(containerID string, reservations []HostPortReservation) error {
+	if len(reservations) == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, owned := range r.pods {
+		if id == containerID {
+			continue
+		}
+
+		for i := range reservations {
+			for j := range owned {
+				if portMappingsConflict(&reservations[i].PortMapping, &owned[j].PortMapping) {
+					return &HostPortConflictError{PortMapping: reservations[i].PortMapping, Owner: owned[j]}
+				}
+			}
+		}
+	}
+
+	for i := range reservations {
+		r.releaseLocked(containerID, reservations[i].Network, reservations[i].Ifname)
+	}
+
+	r.pods[containerID] = append(r.pods[containerID], reservations...)
+
+	return nil
+}
+
+// release removes the reservations of an attachment of a container.
+func (r *hostPortRegistry) release(containerID, network, ifname string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.releaseLocked(containerID, network, ifname)
+}
+
+func (r *hostPortRegistry) releaseLocked(containerID, network, ifname string) {
+	kept := []HostPortReservation{}
+
+	for _, reservation := range r.pods[containerID] {
+		if reservation.Network != network || reservation.Ifname != ifname {
+			kept = append(kept, reservation)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(r.pods, containerID)
+	} else {
+		r.pods[containerID] = kept
+	}
+}
+
+// retain removes the reservations of all containers which are not valid.
+func (r *hostPortRegistry) retain(validIDs map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id := range r.pods {
+		if !validIDs[id] {
+			delete(r.pods, id)
+		}
+	}
+}
+
+// list returns all reservations, sorted by host port, protocol and host IP.
+func (r *hostPortRegistry) list() []HostPortReservation {
+	r.mu.Lock()
+
+	reservations := []HostPortReservation{}
+	for _, owned := range r.pods {
+		reservations = append(reservations, owned...)
+	}
+
+	r.mu.Unlock()
+
+	sort.Slice(reservations, func(i, j int) bool {
+		a, b := &reservations[i], &reservations[j]
+		if a.HostPort != b.HostPort {
+			return a.HostPort < b.HostPort
+		}
+
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+
+		if a.HostIP != b.HostIP {
+			return a.HostIP < b.HostIP
+		}
+
+		return a.ContainerID < b.ContainerID
+	})
+
+	return reservations
+}
+
+// load adds the reservations of all attachments in the CNI cache whose
+// network declares the portMappings capability, using the port mappings of
+// their cached runtime configs.
+func (r *hostPortRegistry) load(cni *libcni.CNIConfig) error {
+	attachments, err := cni.GetCachedAttachments("")
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, attachment := range attachments {
+		mappings, err := cachedPortMappings(attachment)
+		if err != nil {
+			logrus.Warnf("Failed to load port mappings of container %s for CNI network %q: %v",
+				attachment.ContainerID, attachment.Network, err)
+
+			continue
+		}
+
+		podNamespace, podName := podNameFromArgs(attachment.CniArgs)
+
+		for _, pm := range mappings {
+			r.pods[attachment.ContainerID] = append(r.pods[attachment.ContainerID], HostPortReservation{
+				PortMapping:  pm,
+				PodNamespace: podNamespace,
+				PodName:      podName,
+				ContainerID:  attachment.ContainerID,
+				Network:      attachment.Network,
+				Ifname:       attachment.IfName,
+			})
+		}
+	}
+
+	return nil
+}
+
+// cachedPortMappings returns the normalized port mappings of a cached
+// attachment, if its network declares the portMappings capability.
+func cachedPortMappings(attachment *libcni.NetworkAttachment) ([]PortMapping, error) {
+	value, ok := attachment.CapabilityArgs[capabilityPortMappings]
+	if !ok {
+		return nil, nil
+	}
+
+	config, err := libcni.ConfListFromBytes(attachment.Config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cached network config: %w", err)
+	}
+
+	network := &cniNetwork{name: attachment.Network, config: config}
+	if !network.capabilities()[capabilityPortMappings] {
+		return nil, nil
+	}
+
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings := []PortMapping{}
+	if err := json.Unmarshal(bytes, &mappings); err != nil {
+		return nil, fmt.Errorf("invalid cached port mappings: %w", err)
+	}
+
+	// Mappings cached by older versions may not be normalized yet
+	return normalizePortMappings(mappings, nil)
+}
+
+// podNameFromArgs returns the pod namespace and name from the CNI_ARGS of an
+// attachment.
+func podNameFromArgs(args [][2]string) (namespace, name string) {
+	for _, arg := range args {
+		switch arg[0] {
+		case "K8S_POD_NAMESPACE":
+			namespace = arg[1]
+		case "K8S_POD_NAME":
+			name = arg[1]
+		}
+	}
+
+	return namespace, name
+}
+
+// hostPortReservations returns the host port reservations of the port
+// mappings of a pod. Only the port mappings of attachments to networks which
+// declare the portMappings capability reserve host ports, as no plugin binds
+// them otherwise. The networks of the pod must be filled.
+func hostPortReservations(podNetwork *PodNetwork, networks map[string]*cniNetwork) ([]HostPortReservation, error) {
+	reservations := []HostPortReservation{}
+
+	for i := range podNetwork.Networks {
+		attachment := &podNetwork.Networks[i]
+
+		network, ok := networks[attachment.Name]
+		if !ok || !network.capabilities()[capabilityPortMappings] {
+			continue
+		}
+
+		runtimeConfig := podNetwork.runtimeConfigFor(attachment)
+
+		ips, err := staticIPs(runtimeConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		mappings, err := normalizePortMappings(runtimeConfig.PortMappings, ips)
+		if err != nil {
+			return nil, fmt.Errorf("network %q: %w", attachment.Name, err)
+		}
+
+		for _, pm := range mappings {
+			reservations = append(reservations, HostPortReservation{
+				PortMapping:  pm,
+				PodNamespace: podNetwork.Namespace,
+				PodName:      podNetwork.Name,
+				ContainerID:  podNetwork.ID,
+				Network:      attachment.Name,
+				Ifname:       attachment.Ifname,
+			})
+		}
+	}
+
+	return reservations, nil
+}
+
+// reserveHostPorts reserves the host ports of the port mappings of a pod.
+// It returns a function which releases the reservations again, for use if
+// the pod cannot be set up.
+func (plugin *cniNetworkPlugin) reserveHostPorts(podNetwork *PodNetwork) (func(), error) {
+	pod := *podNetwork
+	pod.Networks = slices.Clone(podNetwork.Networks)
+
+	plugin.RLock()
+	err := plugin.fillPodNetworks(&pod)
+	networks := maps.Clone(plugin.networks)
+	plugin.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	reservations, err := hostPortReservations(&pod, networks)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := plugin.hostPorts.reserve(pod.ID, reservations); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		for _, attachment := range pod.Networks {
+			plugin.hostPorts.release(pod.ID, attachment.Name, attachment.Ifname)
+		}
+	}, nil
+}
+
+// HostPorts returns the host ports reserved by the port mappings of all
+// pods, sorted by host port.
+func (plugin *cniNetworkPlugin) HostPorts() []HostPortReservation {
+	return plugin.hostPorts.list()
+}
@@ -0,0 +1,173 @@
+package ocicni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+
+	"github.com/sirupsen/logrus"
+)
+
+// getCachedAttachments returns the cached network attachments of a
+// container, treating a missing cache directory as no attachments.
+func (plugin *cniNetworkPlugin) getCachedAttachments(containerID string) ([]NetAttachment, error) {
+	attachments, err := plugin.getCachedNetworkInfo(containerID)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []NetAttachment{}, nil
+	}
+
+	return attachments, err
+}
+
+// newAttachment validates that attachment does not duplicate one of the
+// existing attachments of a pod, synthesizes its interface name if none is
+// given, and determines whether it is the primary attachment of the pod.
+func (plugin *cniNetworkPlugin) newAttachment(podNetwork *PodNetwork, attachment NetAttachment, existing []NetAttachment) (NetAttachment, error) {
+	for _, att := range existing {
+		switch {
+		case attachment.Ifname != "" && att.Ifname == attachment.Ifname:
+			if att.Name == attachment.Name {
+				return attachment, fmt.Errorf("network %q is already attached as interface %q", att.Name, att.Ifname)
+			}
+
+			return attachment, fmt.Errorf("interface name %q is already used by network %q", att.Ifname, att.Name)
+		case attachment.Ifname == "" && att.Name == attachment.Name:
+			return attachment, fmt.Errorf("network %q is already attached as interface %q, an interface name is required to attach it again", att.Name, att.Ifname)
+		}
+	}
+
+	// Let fillPodNetworks validate the attachment and pick an interface
+	// name which is not used by any of the existing attachments
+	pod := *podNetwork
+	pod.Networks = append(slices.Clone(existing), attachment)
+
+	plugin.RLock()
+	err := plugin.fillPodNetworks(&pod)
+	plugin.RUnlock()
+
+	if err != nil {
+		return attachment, err
+	}
+
+	return pod.Networks[len(pod.Networks)-1], nil
+}
+
+// AttachNetwork attaches a single network to a pod which has already been
+// set up. The existing attachments of the pod are taken from the CNI cache:
+// attaching a network twice under the same interface name, or reusing an
+// interface name, is refused. If the attachment has no interface name, a
+// free one is picked. The attachment is configured with runtimeConfig and
+// the args of its AttachmentConfig entry, if any. If the network cannot be
+// added, it is deleted again so that no partial attachment remains.
+//
+//nolint:gocritic // consistent with SetUpPod
+func (plugin *cniNetworkPlugin) AttachNetwork(ctx context.Context, podNetwork PodNetwork, attachment NetAttachment, runtimeConfig RuntimeConfig) (*NetResult, error) {
+	if attachment.Name == "" {
+		return nil, errors.New("no network name given to attach")
+	}
+
+	plugin.gcLock.RLock()
+	defer plugin.gcLock.RUnlock()
+
+	ctx = plugin.podLock(&podNetwork).startOperation(ctx, OperationAdd)
+	defer plugin.podUnlock(&podNetwork)
+
+	unlock, err := plugin.podFileLock(&podNetwork)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	existing, err := plugin.getCachedAttachments(podNetwork.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached attachments of pod %s: %w", buildFullPodName(&podNetwork), err)
+	}
+
+	attachment, err = plugin.newAttachment(&podNetwork, attachment, existing)
+	if err != nil {
+		return nil, err
+	}
+
+	key := NetAttachmentKey{Name: attachment.Name, Ifname: attachment.Ifname}
+	podNetwork.Networks = []NetAttachment{attachment}
+	podNetwork.RuntimeConfig = nil
+	podNetwork.AttachmentConfig = map[NetAttachmentKey]NetAttachmentConfig{
+		key: {RuntimeConfig: &runtimeConfig, Args: podNetwork.AttachmentConfig[key].Args},
+	}
+
+	releaseHostPorts, err := plugin.reserveHostPorts(&podNetwork)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := plugin.addPodNetworks(ctx, &podNetwork)
+	if err != nil {
+		releaseHostPorts()
+
+		if delErr := plugin.deletePodNetworks(ctx, &podNetwork); delErr != nil {
+			logrus.Warnf("Failed to clean up failed attachment of network %q: %v", attachment.Name, delErr)
+		}
+
+		return nil, err
+	}
+
+	// The attachment is only primary if it would have been primary when
+	// the pod was set up with it
+	result := results[0]
+	result.Primary = attachment.Primary
+
+	return &result, nil
+}
+
+// DetachNetwork detaches a single network from a pod, leaving its other
+// attachments in place. If the attachment has no interface name, the network
+// must be attached exactly once according to the CNI cache.
+//
+//nolint:gocritic // consistent with TearDownPod
+func (plugin *cniNetworkPlugin) DetachNetwork(ctx context.Context, podNetwork PodNetwork, attachment NetAttachment) error {
+	if attachment.Name == "" {
+		return errors.New("no network name given to detach")
+	}
+
+	plugin.gcLock.RLock()
+	defer plugin.gcLock.RUnlock()
+
+	ctx = plugin.podLock(&podNetwork).startOperation(ctx, OperationDel)
+	defer plugin.podUnlock(&podNetwork)
+
+	unlock, err := plugin.podFileLock(&podNetwork)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if attachment.Ifname == "" {
+		existing, err := plugin.getCachedAttachments(podNetwork.ID)
+		if err != nil {
+			return fmt.Errorf("failed to read cached attachments of pod %s: %w", buildFullPodName(&podNetwork), err)
+		}
+
+		var matches []NetAttachment
+
+		for _, att := range existing {
+			if att.Name == attachment.Name {
+				matches = append(matches, att)
+			}
+		}
+
+		switch len(matches) {
+		case 0:
+			return fmt.Errorf("network %q is not attached to pod %s", attachment.Name, buildFullPodName(&podNetwork))
+		case 1:
+			attachment = matches[0]
+		default:
+			return fmt.Errorf("network %q is attached to pod %s more than once, an interface name is required", attachment.Name, buildFullPodName(&podNetwork))
+		}
+	}
+
+	podNetwork.Networks = []NetAttachment{attachment}
+
+	return plugin.deletePodNetworks(ctx, &podNetwork)
+}
@@ -0,0 +1,203 @@
+package ocicni
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/utils"
+)
+
+const (
+	// DefaultInterfacePrefix is the prefix of synthesized interface names
+	// if no other prefix is configured.
+	DefaultInterfacePrefix = "eth"
+
+	// ifnamePrefixKey is the top-level conflist key which sets the prefix
+	// of synthesized interface names for the network.
+	ifnamePrefixKey = "ifnamePrefix"
+
+	// maxIfnameCandidates is the number of candidates tried when
+	// synthesizing an interface name from a prefix.
+	maxIfnameCandidates = 10000
+)
+
+// InterfaceNamer picks the interface name of the attachment at index in
+// podNetwork.Networks, which has no explicit interface name. The taken
+// function reports whether a name is already used by another attachment of
+// the pod. If the namer returns an empty name, the prefix based naming is
+// used for the attachment.
+type InterfaceNamer func(podNetwork *PodNetwork, index int, taken func(ifname string) bool) (string, error)
+
+// MultusInterfaceNamer follows the Multus conventions: the first attachment
+// of a pod is named using the prefix based naming (usually eth0), while all
+// further attachments are named net1, net2, and so on.
+func MultusInterfaceNamer(_ *PodNetwork, index int, taken func(ifname string) bool) (string, error) {
+	if index == 0 {
+		return "", nil
+	}
+
+	for i := 1; i < maxIfnameCandidates; i++ {
+		candidate := fmt.Sprintf("net%d", i)
+		if !taken(candidate) {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("no free interface name with prefix %q", "net")
+}
+
+// WithInterfacePrefix sets the prefix of synthesized interface names, which
+// defaults to DefaultInterfacePrefix. The prefix may be overridden per
+// network by WithNetworkInterfacePrefix or by an "ifnamePrefix" key in the
+// network's conflist.
+func WithInterfacePrefix(prefix string) Option {
+	return func(plugin *cniNetworkPlugin) error {
+		if err := validateIfnamePrefix(prefix); err != nil {
+			return err
+		}
+
+		plugin.ifnamePrefix = prefix
+
+		return nil
+	}
+}
+
+// WithNetworkInterfacePrefix sets the prefix of synthesized interface names
+// for a single network. It takes precedence over the "ifnamePrefix" key in
+// the conflist of the network.
+func WithNetworkInterfacePrefix(network, prefix string) Option {
+	return func(plugin *cniNetworkPlugin) error {
+		if err := validateIfnamePrefix(prefix); err != nil {
+			return err
+		}
+
+		if plugin.networkIfnamePrefixes == nil {
+			plugin.networkIfnamePrefixes = make(map[string]string)
+		}
+
+		plugin.networkIfnamePrefixes[network] = prefix
+
+		return nil
+	}
+}
+
+// WithInterfaceNamer sets a callback which is asked first for the name of
+// every attachment without an explicit interface name.
+func WithInterfaceNamer(namer InterfaceNamer) Option {
+	return func(plugin *cniNetworkPlugin) error {
+		plugin.ifnameNamer = namer
+
+		return nil
+	}
+}
+
+// validateIfname checks that ifname is a valid Linux interface name: not
+// empty, shorter than IFNAMSIZ, not "." or "..", and without '/', ':' or
+// whitespace.
+func validateIfname(ifname string) error {
+	if err := utils.ValidateInterfaceName(ifname); err != nil {
+		return fmt.Errorf("invalid interface name %q: %w", ifname, err)
+	}
+
+	return nil
+}
+
+func validateIfnamePrefix(prefix string) error {
+	if prefix == "" {
+		return errors.New("empty interface name prefix")
+	}
+
+	// The shortest name synthesized from the prefix must be valid
+	return validateIfname(prefix + "0")
+}
+
+// parseIfnamePrefix returns the interface name prefix configured in the raw
+// bytes of a conflist, if any.
+func parseIfnamePrefix(confBytes []byte) (string, error) {
+	conf := map[string]any{}
+	if err := json.Unmarshal(confBytes, &conf); err != nil {
+		return "", err
+	}
+
+	value, ok := conf[ifnamePrefixKey]
+	if !ok {
+		return "", nil
+	}
+
+	prefix, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", ifnamePrefixKey)
+	}
+
+	if err := validateIfnamePrefix(prefix); err != nil {
+		return "", err
+	}
+
+	return prefix, nil
+}
+
+// ifnamePrefixFor returns the interface name prefix of a network.
+//
+// plugin RLock must be held.
+func (plugin *cniNetworkPlugin) ifnamePrefixFor(network string) string {
+	if prefix, ok := plugin.networkIfnamePrefixes[network]; ok {
+		return prefix
+	}
+
+	if cniNet, ok := plugin.networks[network]; ok && cniNet.ifnamePrefix != "" {
+		return cniNet.ifnamePrefix
+	}
+
+	if plugin.ifnamePrefix != "" {
+		return plugin.ifnamePrefix
+	}
+
+	return DefaultInterfacePrefix
+}
+
+// synthesizeIfname picks a free interface name for the attachment at index
+// in podNetwork.Networks.
+//
+// plugin RLock must be held.
+func (plugin *cniNetworkPlugin) synthesizeIfname(podNetwork *PodNetwork, index int, allIfNames map[string]bool) (string, error) {
+	network := podNetwork.Networks[index].Name
+
+	taken := func(ifname string) bool {
+		return allIfNames[ifname]
+	}
+
+	if plugin.ifnameNamer != nil {
+		candidate, err := plugin.ifnameNamer(podNetwork, index, taken)
+		if err != nil {
+			return "", fmt.Errorf("failed to name interface for network %q: %w", network, err)
+		}
+
+		if candidate != "" {
+			if err := validateIfname(candidate); err != nil {
+				return "", fmt.Errorf("network %q: %w", network, err)
+			}
+
+			if taken(candidate) {
+				return "", fmt.Errorf("network %q synthesized interface name %q already assigned", network, candidate)
+			}
+
+			return candidate, nil
+		}
+	}
+
+	prefix := plugin.ifnamePrefixFor(network)
+
+	for j := range maxIfnameCandidates {
+		candidate := fmt.Sprintf("%s%d", prefix, j)
+		if validateIfname(candidate) != nil {
+			break
+		}
+
+		if !taken(candidate) {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("failed to find free interface name for network %q", network)
+}
@@ -0,0 +1,210 @@
+package ocicni
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/containernetworking/cni/libcni"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/sirupsen/logrus"
+)
+
+// LiveRoute is a route through an interface in the network namespace of a
+// pod.
+type LiveRoute struct {
+	// Dst is the destination of the route, 0.0.0.0/0 or ::/0 for default
+	// routes.
+	Dst net.IPNet
+	// GW is the gateway of the route, if any.
+	GW net.IP
+}
+
+// LiveInterfaceStatus is the current state of an interface in the network
+// namespace of a pod, as read from the kernel.
+type LiveInterfaceStatus struct {
+	// Name is the name of the interface.
+	Name string
+	// MAC is the hardware address of the interface.
+	MAC string
+	// MTU is the MTU of the interface.
+	MTU int
+	// OperState is the operational state of the interface, like "up",
+	// "down" or "unknown".
+	OperState string
+	// Up is whether the interface is administratively up.
+	Up bool
+	// Carrier is whether the interface has a carrier.
+	Carrier bool
+	// IPs are the global addresses of the interface, IPv4 first.
+	IPs []*net.IPNet
+	// Routes are the routes through the interface in the main routing
+	// table. It is nil on platforms where routes are not read.
+	Routes []LiveRoute
+	// Gateways are the gateways of the default routes through the
+	// interface.
+	Gateways []net.IP
+}
+
+// LiveNetResult is the live status of a network attachment of a pod.
+type LiveNetResult struct {
+	// NetResult contains the network attachment and its cached CNI
+	// result, which is nil if there is none.
+	NetResult
+
+	// Interface is the live status of the interface of the attachment.
+	Interface *LiveInterfaceStatus
+
+	// Discrepancies describe how the live status differs from the cached
+	// CNI result.
+	Discrepancies []string
+}
+
+// isDefaultRoute reports whether a route destination matches all addresses.
+func isDefaultRoute(dst *net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+
+	return ones == 0
+}
+
+// liveStatusDiscrepancies returns how the live status of an interface differs
+// from the cached CNI result of its attachment.
+func liveStatusDiscrepancies(result cnitypes.Result, live *LiveInterfaceStatus) ([]string, error) {
+	discrepancies := []string{}
+
+	if !live.Up {
+		discrepancies = append(discrepancies, fmt.Sprintf("interface %s is down", live.Name))
+	} else if !live.Carrier {
+		discrepancies = append(discrepancies, fmt.Sprintf("interface %s has no carrier", live.Name))
+	}
+
+	if result == nil {
+		return append(discrepancies, "no cached CNI result"), nil
+	}
+
+	cached, err := cniv1.NewResultFromResult(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert cached CNI result: %w", err)
+	}
+
+	index := slices.IndexFunc(cached.Interfaces, func(iface *cniv1.Interface) bool {
+		return iface.Name == live.Name && iface.Sandbox != ""
+	})
+
+	if index < 0 {
+		discrepancies = append(discrepancies, fmt.Sprintf("interface %s is not in the CNI result", live.Name))
+	} else {
+		iface := cached.Interfaces[index]
+
+		if mac, err := net.ParseMAC(iface.Mac); err == nil && mac.String() != live.MAC {
+			discrepancies = append(discrepancies, fmt.Sprintf("MAC %s differs from %s in the CNI result", live.MAC, iface.Mac))
+		}
+
+		if iface.Mtu != 0 && iface.Mtu != live.MTU {
+			discrepancies = append(discrepancies, fmt.Sprintf("MTU %d differs from %d in the CNI result", live.MTU, iface.Mtu))
+		}
+	}
+
+	cachedIPs := []string{}
+
+	for _, ip := range cached.IPs {
+		if ip.Interface == nil || index < 0 || *ip.Interface == index {
+			cachedIPs = append(cachedIPs, ip.Address.String())
+		}
+	}
+
+	liveIPs := []string{}
+	for _, ip := range live.IPs {
+		liveIPs = append(liveIPs, ip.String())
+	}
+
+	for _, ip := range cachedIPs {
+		if !slices.Contains(liveIPs, ip) {
+			discrepancies = append(discrepancies, fmt.Sprintf("address %s in the CNI result is missing", ip))
+		}
+	}
+
+	for _, ip := range liveIPs {
+		if !slices.Contains(cachedIPs, ip) {
+			discrepancies = append(discrepancies, fmt.Sprintf("address %s is not in the CNI result", ip))
+		}
+	}
+
+	// Routes are only compared if they could be read
+	if live.Routes == nil {
+		return discrepancies, nil
+	}
+
+	for _, route := range cached.Routes {
+		if !slices.ContainsFunc(live.Routes, func(liveRoute LiveRoute) bool {
+			return liveRoute.Dst.String() == route.Dst.String() && (route.GW == nil || route.GW.Equal(liveRoute.GW))
+		}) {
+			discrepancies = append(discrepancies, fmt.Sprintf("route to %s in the CNI result is missing", route.Dst.String()))
+		}
+	}
+
+	return discrepancies, nil
+}
+
+// GetPodNetworkLiveStatus returns the current state of the interfaces of all
+// networks attached to the pod, read from its network namespace rather than
+// the CNI result cache, together with their differences from the cached CNI
+// results. Unlike GetPodNetworkStatus, it does not invoke CNI plugins.
+//
+//nolint:gocritic // consistent with GetPodNetworkStatusWithContext
+func (plugin *cniNetworkPlugin) GetPodNetworkLiveStatus(ctx context.Context, podNetwork PodNetwork) ([]LiveNetResult, error) {
+	ctx = plugin.podLock(&podNetwork).startOperation(ctx, OperationCheck)
+	defer plugin.podUnlock(&podNetwork)
+
+	unlock, err := plugin.podFileLock(&podNetwork)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	results := []LiveNetResult{}
+
+	if err := plugin.forEachNetwork(ctx, &podNetwork, true, func(network *cniNetwork, podNetwork *PodNetwork, attachment *NetAttachment, rt *libcni.RuntimeConf) error {
+		fullPodName := buildFullPodName(podNetwork)
+
+		result, err := plugin.cniConfig.GetNetworkListCachedResult(network.config, rt)
+		if err != nil {
+			return fmt.Errorf("error getting cached result of pod %s for CNI network %q: %w", fullPodName, network.name, err)
+		}
+
+		live, err := getLiveInterfaceStatus(ctx, podNetwork.NetNS, rt.IfName)
+		if err != nil {
+			return fmt.Errorf("error reading live status of pod %s for CNI network %q: %w", fullPodName, network.name, err)
+		}
+
+		discrepancies, err := liveStatusDiscrepancies(result, live)
+		if err != nil {
+			return fmt.Errorf("error comparing live status of pod %s for CNI network %q: %w", fullPodName, network.name, err)
+		}
+
+		for _, discrepancy := range discrepancies {
+			logrus.Warnf("Pod %s CNI network %q: %s", fullPodName, network.name, discrepancy)
+		}
+
+		results = append(results, LiveNetResult{
+			NetResult: NetResult{
+				Result: result,
+				NetAttachment: NetAttachment{
+					Name:    network.name,
+					Ifname:  rt.IfName,
+					Primary: attachment.Primary,
+				},
+			},
+			Interface:     live,
+			Discrepancies: discrepancies,
+		})
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,168 @@
+package ocicni
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containernetworking/cni/libcni"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+)
+
+// LoopbackPolicy determines how the loopback interface of a pod is set up.
+type LoopbackPolicy string
+
+const (
+	// LoopbackNetlink brings up the loopback interface directly, using
+	// netlink on Linux and ifconfig on FreeBSD. This is the default.
+	LoopbackNetlink LoopbackPolicy = "netlink"
+	// LoopbackPlugin invokes the standard CNI loopback plugin, so that the
+	// loopback attachment is recorded in the CNI cache. It is only
+	// supported on Linux.
+	LoopbackPlugin LoopbackPolicy = "plugin"
+	// LoopbackSkip leaves the loopback interface to the runtime.
+	LoopbackSkip LoopbackPolicy = "skip"
+)
+
+const (
+	// loopbackNetName is the network name of the loopback attachment if
+	// the CNI loopback plugin is used.
+	loopbackNetName = "cni-loopback"
+
+	loopbackConfList = `{
+	"cniVersion": "0.4.0",
+	"name": "` + loopbackNetName + `",
+	"plugins": [{"type": "loopback"}]
+}`
+)
+
+// WithLoopbackPolicy sets how the loopback interface of pods is set up and
+// checked. It defaults to LoopbackNetlink.
+func WithLoopbackPolicy(policy LoopbackPolicy) Option {
+	return func(plugin *cniNetworkPlugin) error {
+		switch policy {
+		case LoopbackNetlink, LoopbackSkip:
+		case LoopbackPlugin:
+			if !loopbackPluginSupported {
+				return fmt.Errorf("loopback policy %q is not supported on this platform", policy)
+			}
+		default:
+			return fmt.Errorf("unknown loopback policy %q", policy)
+		}
+
+		plugin.loopbackPolicy = policy
+
+		return nil
+	}
+}
+
+// loopbackNetwork returns the network configuration and runtime config of
+// the loopback attachment of a pod, for use with the CNI loopback plugin.
+func (plugin *cniNetworkPlugin) loopbackNetwork(podNetwork *PodNetwork) (*libcni.NetworkConfigList, *libcni.RuntimeConf, error) {
+	confList, err := libcni.ConfListFromBytes([]byte(loopbackConfList))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rt, err := buildCNIRuntimeConf(podNetwork, &NetAttachment{Name: loopbackNetName, Ifname: loIfname}, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rt.Args = append(rt.Args, plugin.envArgs()...)
+
+	return confList, rt, nil
+}
+
+// setUpLoopback sets up the loopback interface of a pod according to the
+// loopback policy.
+func (plugin *cniNetworkPlugin) setUpLoopback(ctx context.Context, podNetwork *PodNetwork) error {
+	switch plugin.loopbackPolicy {
+	case LoopbackSkip:
+		return nil
+	case LoopbackPlugin:
+		confList, rt, err := plugin.loopbackNetwork(podNetwork)
+		if err == nil {
+			setOperationNetwork(ctx, loopbackNetName)
+			_, err = plugin.cniConfig.AddNetworkList(ctx, confList, rt)
+		}
+
+		if err != nil {
+			return fmt.Errorf("error adding loopback interface: %w", err)
+		}
+
+		return nil
+	default:
+		return bringUpLoopback(podNetwork.NetNS)
+	}
+}
+
+// checkPodLoopback checks the loopback interface of a pod according to the
+// loopback policy.
+func (plugin *cniNetworkPlugin) checkPodLoopback(ctx context.Context, podNetwork *PodNetwork) error {
+	switch plugin.loopbackPolicy {
+	case LoopbackSkip:
+		return nil
+	case LoopbackPlugin:
+		confList, rt, err := plugin.loopbackNetwork(podNetwork)
+		if err == nil {
+			setOperationNetwork(ctx, loopbackNetName)
+			err = plugin.cniConfig.CheckNetworkList(ctx, confList, rt)
+		}
+
+		if err != nil {
+			return fmt.Errorf("error checking loopback interface: %w", err)
+		}
+
+		return nil
+	default:
+		return checkLoopback(podNetwork.NetNS)
+	}
+}
+
+// tearDownLoopback removes the loopback attachment of a pod if the CNI
+// loopback plugin is used. Otherwise the loopback interface goes away with
+// the network namespace.
+func (plugin *cniNetworkPlugin) tearDownLoopback(ctx context.Context, podNetwork *PodNetwork) error {
+	if plugin.loopbackPolicy != LoopbackPlugin {
+		return nil
+	}
+
+	confList, rt, err := plugin.loopbackNetwork(podNetwork)
+	if err == nil {
+		setOperationNetwork(ctx, loopbackNetName)
+		err = plugin.cniConfig.DelNetworkList(ctx, confList, rt)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error removing loopback interface: %w", err)
+	}
+
+	return nil
+}
+
+// gcLoopback removes the cached loopback attachments of pods which are not
+// valid if the CNI loopback plugin is used, as they are not part of any
+// network.
+func (plugin *cniNetworkPlugin) gcLoopback(ctx context.Context, validPods []*PodNetwork) error {
+	if plugin.loopbackPolicy != LoopbackPlugin {
+		return nil
+	}
+
+	confList, err := libcni.ConfListFromBytes([]byte(loopbackConfList))
+	if err != nil {
+		return err
+	}
+
+	args := &libcni.GCArgs{
+		ValidAttachments: make([]cnitypes.GCAttachment, 0, len(validPods)),
+	}
+
+	for _, pod := range validPods {
+		args.ValidAttachments = append(args.ValidAttachments, cnitypes.GCAttachment{
+			ContainerID: pod.ID,
+			IfName:      loIfname,
+		})
+	}
+
+	return plugin.cniConfig.GCNetworkList(ctx, confList, args)
+}
@@ -1,19 +1,24 @@
 package ocicni
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/fs"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/containernetworking/cni/libcni"
 	cniinvoke "github.com/containernetworking/cni/pkg/invoke"
@@ -31,9 +36,8 @@ type cniNetworkPlugin struct {
 	defaultNetName netName
 	networks       map[string]*cniNetwork
 
-	nsManager *nsManager
-	confDir   string
-	binDirs   []string
+	confDir string
+	binDirs []string
 
 	shutdownChan chan struct{}
 	watcher      *fsnotify.Watcher
@@ -42,9 +46,9 @@ type cniNetworkPlugin struct {
 	// The pod map provides synchronization for a given pod's network
 	// operations.  Each pod's setup/teardown/status operations
 	// are synchronized against each other, but network operations of other
-	// pods can proceed in parallel.
-	podsLock sync.Mutex
-	pods     map[string]*podLock
+	// pods can proceed in parallel. The map is sharded by pod name to
+	// reduce contention on the map locks with many concurrent pods.
+	podShards [podLockShards]podLockShard
 
 	// The gcLock blocks *all* pod operations from taking place
 	// while GC is happening.
@@ -52,11 +56,55 @@ type cniNetworkPlugin struct {
 	// This must be acquired first, to prevent deadlocks.
 	gcLock sync.RWMutex
 
+	// Set while GC holds gcLock, for debugging
+	gcRunning atomic.Bool
+
+	// Cross-process locks, only set if file locking is enabled. These are
+	// acquired after the in-memory locks above.
+	useFileLocks bool
+	fileLocker   *fileLocker
+
+	// Interface naming policy for attachments without interface name
+	ifnamePrefix          string
+	networkIfnamePrefixes map[string]string
+	ifnameNamer           InterfaceNamer
+
+	// How the loopback interface of pods is set up
+	loopbackPolicy LoopbackPolicy
+
+	// Host ports reserved by the port mappings of pods
+	hostPorts *hostPortRegistry
+
+	// Whether the CNI_ARGS of the environment are passed to the plugins
+	propagateEnvArgs bool
+
+	// Hooks called around each network operation
+	preHooks  []Hook
+	postHooks []Hook
+
+	// Time each network has to answer STATUS in StatusAll
+	statusTimeout time.Duration
+
+	// STATUS result of the default network, if caching is enabled
+	statusCache statusCache
+
+	// Background health check of attached pods, if enabled
+	healthCheck *healthCheckConfig
+
 	// For testcases
 	exec     cniinvoke.Exec
 	cacheDir string
 }
 
+var (
+	_ NetworkAttacher       = &cniNetworkPlugin{}
+	_ DryRunner             = &cniNetworkPlugin{}
+	_ HostPortLister        = &cniNetworkPlugin{}
+	_ LiveStatusReader      = &cniNetworkPlugin{}
+	_ NetworkStatusReporter = &cniNetworkPlugin{}
+	_ Debugger              = &cniNetworkPlugin{}
+)
+
 type netName struct {
 	name       string
 	changeable bool
@@ -66,10 +114,16 @@ type cniNetwork struct {
 	name     string
 	filePath string
 	config   *libcni.NetworkConfigList
+
+	// Prefix of synthesized interface names from the conflist, if any
+	ifnamePrefix string
 }
 
 const errMissingDefaultNetwork = "no CNI configuration file in %s. Has your network provider started?"
 
+// podLockShards is the number of shards of the pod lock map.
+const podLockShards = 64
+
 type podLock struct {
 	// Count of in-flight operations for this pod; when this reaches zero
 	// the lock can be removed from the pod map
@@ -77,40 +131,86 @@ type podLock struct {
 
 	// Lock to synchronize operations for this specific pod
 	mu sync.Mutex
+
+	// The operation currently holding mu, for debugging
+	op podOperation
+}
+
+// podLockShard is a part of the pod map, holding the locks of all pods whose
+// name hashes to the shard.
+type podLockShard struct {
+	sync.Mutex
+
+	pods map[string]*podLock
 }
 
 func buildFullPodName(podNetwork *PodNetwork) string {
 	return podNetwork.Namespace + "_" + podNetwork.Name
 }
 
+// podShard returns the pod map shard responsible for the given pod name.
+func (plugin *cniNetworkPlugin) podShard(fullPodName string) *podLockShard {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(fullPodName))
+
+	return &plugin.podShards[hash.Sum32()%podLockShards]
+}
+
+// podLockCount returns the number of pods in the pod map.
+func (plugin *cniNetworkPlugin) podLockCount() int {
+	count := 0
+
+	for i := range plugin.podShards {
+		shard := &plugin.podShards[i]
+		shard.Lock()
+		count += len(shard.pods)
+		shard.Unlock()
+	}
+
+	return count
+}
+
 // Lock network operations for a specific pod.  If that pod is not yet in
 // the pod map, it will be added.  The reference count for the pod will
 // be increased.
-func (plugin *cniNetworkPlugin) podLock(podNetwork *PodNetwork) {
-	plugin.podsLock.Lock()
-
+func (plugin *cniNetworkPlugin) podLock(podNetwork *PodNetwork) *podLock {
 	fullPodName := buildFullPodName(podNetwork)
+	shard := plugin.podShard(fullPodName)
+
+	shard.Lock()
 
-	lock, ok := plugin.pods[fullPodName]
+	lock, ok := shard.pods[fullPodName]
 	if !ok {
 		lock = &podLock{}
-		plugin.pods[fullPodName] = lock
+		shard.pods[fullPodName] = lock
 	}
 
 	lock.refcount++
-	plugin.podsLock.Unlock()
+	shard.Unlock()
 	lock.mu.Lock()
+
+	return lock
+}
+
+// startOperation records operation as the operation holding the pod lock.
+// The returned context is used to track the progress of the operation.
+func (lock *podLock) startOperation(ctx context.Context, operation Operation) context.Context {
+	lock.op.start(operation)
+
+	return withPodOperation(ctx, &lock.op)
 }
 
 // Unlock network operations for a specific pod.  The reference count for the
 // pod will be decreased.  If the reference count reaches zero, the pod will be
 // removed from the pod map.
 func (plugin *cniNetworkPlugin) podUnlock(podNetwork *PodNetwork) {
-	plugin.podsLock.Lock()
-	defer plugin.podsLock.Unlock()
-
 	fullPodName := buildFullPodName(podNetwork)
-	lock, ok := plugin.pods[fullPodName]
+	shard := plugin.podShard(fullPodName)
+
+	shard.Lock()
+	defer shard.Unlock()
+
+	lock, ok := shard.pods[fullPodName]
 
 	if !ok {
 		logrus.Errorf("Cannot find reference in refcount map for %s. Refcount cannot be determined.", fullPodName)
@@ -118,18 +218,47 @@ func (plugin *cniNetworkPlugin) podUnlock(podNetwork *PodNetwork) {
 		return
 	} else if lock.refcount == 0 {
 		// This should never ever happen, but handle it anyway
-		delete(plugin.pods, fullPodName)
+		delete(shard.pods, fullPodName)
 		logrus.Errorf("Pod lock for %s still in map with zero refcount", fullPodName)
 
 		return
 	}
 
 	lock.refcount--
+	lock.op.reset()
 	lock.mu.Unlock()
 
 	if lock.refcount == 0 {
-		delete(plugin.pods, fullPodName)
+		delete(shard.pods, fullPodName)
+	}
+}
+
+// Lock the cross-process locks of a pod's sandbox container, if file locking
+// is enabled. The GC lock file is locked shared before the container lock
+// file, so that GC never removes a container lock file which is held or
+// waited for. The in-memory pod lock must already be held. The returned
+// function releases the acquired locks.
+func (plugin *cniNetworkPlugin) podFileLock(podNetwork *PodNetwork) (func(), error) {
+	if plugin.fileLocker == nil {
+		return func() {}, nil
+	}
+
+	gcLock, err := plugin.fileLocker.lockGC(false)
+	if err != nil {
+		return nil, err
+	}
+
+	containerLock, err := plugin.fileLocker.lockContainer(podNetwork.ID)
+	if err != nil {
+		gcLock.unlock()
+
+		return nil, err
 	}
+
+	return func() {
+		containerLock.unlock()
+		gcLock.unlock()
+	}, nil
 }
 
 func newWatcher(dirs []string) (*fsnotify.Watcher, error) {
@@ -163,7 +292,6 @@ func newWatcher(dirs []string) (*fsnotify.Watcher, error) {
 
 func (plugin *cniNetworkPlugin) monitorConfDir(ctx context.Context, start *sync.WaitGroup) {
 	start.Done()
-	plugin.done.Add(1)
 
 	defer plugin.done.Done()
 
@@ -241,6 +369,10 @@ func InitCNINoInotify(defaultNetName, confDir, cacheDir string, binDirs ...strin
 
 // Internal function to allow faking out exec functions for testing.
 func initCNI(exec cniinvoke.Exec, cacheDir, defaultNetName, confDir string, useInotify bool, binDirs ...string) (CNIPlugin, error) {
+	return newCNIPlugin(exec, cacheDir, defaultNetName, confDir, useInotify, binDirs, nil)
+}
+
+func newCNIPlugin(exec cniinvoke.Exec, cacheDir, defaultNetName, confDir string, useInotify bool, binDirs []string, opts []Option) (CNIPlugin, error) {
 	if confDir == "" {
 		confDir = DefaultConfDir
 	}
@@ -257,29 +389,46 @@ func initCNI(exec cniinvoke.Exec, cacheDir, defaultNetName, confDir string, useI
 	}
 
 	plugin := &cniNetworkPlugin{
-		cniConfig: libcni.NewCNIConfigWithCacheDir(binDirs, cacheDir, exec),
+		cniConfig: libcni.NewCNIConfigWithCacheDir(binDirs, cacheDir, &trackingExec{Exec: exec}),
 		defaultNetName: netName{
 			name: defaultNetName,
 			// If defaultNetName is not assigned in initialization,
 			// it should be changeable
 			changeable: defaultNetName == "",
 		},
-		networks:     make(map[string]*cniNetwork),
-		confDir:      confDir,
-		binDirs:      binDirs,
-		shutdownChan: make(chan struct{}),
-		done:         &sync.WaitGroup{},
-		pods:         make(map[string]*podLock),
-		exec:         exec,
-		cacheDir:     cacheDir,
+		networks:      make(map[string]*cniNetwork),
+		confDir:       confDir,
+		binDirs:       binDirs,
+		shutdownChan:  make(chan struct{}),
+		done:          &sync.WaitGroup{},
+		exec:          exec,
+		cacheDir:      cacheDir,
+		hostPorts:     newHostPortRegistry(),
+		statusTimeout: defaultStatusTimeout,
 	}
 
-	nsm, err := newNSManager()
-	if err != nil {
-		return nil, err
+	for i := range plugin.podShards {
+		plugin.podShards[i].pods = make(map[string]*podLock)
+	}
+
+	for _, opt := range opts {
+		if err := opt(plugin); err != nil {
+			return nil, err
+		}
+	}
+
+	if plugin.useFileLocks {
+		locker, err := newFileLocker(plugin.getCacheDir())
+		if err != nil {
+			return nil, err
+		}
+
+		plugin.fileLocker = locker
 	}
 
-	plugin.nsManager = nsm
+	if err := plugin.hostPorts.load(plugin.cniConfig); err != nil {
+		logrus.Warnf("Failed to load host port reservations from the CNI cache: %v", err)
+	}
 
 	ctx := context.Background()
 	if err := plugin.syncNetworkConfig(ctx); err != nil {
@@ -287,19 +436,28 @@ func initCNI(exec cniinvoke.Exec, cacheDir, defaultNetName, confDir string, useI
 	}
 
 	if useInotify {
-		plugin.watcher, err = newWatcher(append([]string{plugin.confDir}, binDirs...))
+		watcher, err := newWatcher(append([]string{plugin.confDir}, binDirs...))
 		if err != nil {
 			return nil, err
 		}
 
+		plugin.watcher = watcher
+
 		startWg := sync.WaitGroup{}
 		startWg.Add(1)
+		plugin.done.Add(1)
 
 		go plugin.monitorConfDir(ctx, &startWg)
 
 		startWg.Wait()
 	}
 
+	if plugin.healthCheck != nil {
+		plugin.done.Add(1)
+
+		go plugin.healthCheckLoop()
+	}
+
 	return plugin, nil
 }
 
@@ -382,10 +540,16 @@ func loadNetworks(ctx context.Context, confDir string, cni *libcni.CNIConfig) (n
 			confList.Name = path.Base(confFile)
 		}
 
+		ifnamePrefix, err := parseIfnamePrefix(confList.Bytes)
+		if err != nil {
+			logrus.Warnf("Ignoring invalid interface name prefix in CNI config file %s: %v", confFile, err)
+		}
+
 		cniNet := &cniNetwork{
-			name:     confList.Name,
-			filePath: confFile,
-			config:   confList,
+			name:         confList.Name,
+			filePath:     confFile,
+			config:       confList,
+			ifnamePrefix: ifnamePrefix,
 		}
 
 		logrus.Infof("Found CNI network %s (type=%v) at %s", confList.Name, confList.Plugins[0].Network.Type, confFile)
@@ -406,8 +570,33 @@ func loadNetworks(ctx context.Context, confDir string, cni *libcni.CNIConfig) (n
 
 const loIfname string = "lo"
 
+// Names of the CNI capabilities set in the runtime config. These must not
+// be used in RuntimeConfig.CapabilityArgs.
+const (
+	capabilityPortMappings   = "portMappings"
+	capabilityBandwidth      = "bandwidth"
+	capabilityIPRanges       = "ipRanges"
+	capabilityIPs            = "ips"
+	capabilityAliases        = "aliases"
+	capabilityCgroupPath     = "cgroupPath"
+	capabilityDNS            = "dns"
+	capabilityMAC            = "mac"
+	capabilityDeviceID       = "deviceID"
+	capabilityInfinibandGUID = "infinibandGUID"
+	capabilityPodAnnotations = "io.kubernetes.cri.pod-annotations"
+)
+
 const keyValuePairLen = 2
 
+const (
+	// pciAddressPattern matches PCI addresses: a 16 bit domain, an 8 bit
+	// bus, a 5 bit device and a 3 bit function.
+	pciAddressPattern = `^[0-9a-fA-F]{4}:[0-9a-fA-F]{2}:[0-1][0-9a-fA-F]\.[0-7]$`
+
+	// infinibandGUIDLen is the length of an InfiniBand GUID in bytes.
+	infinibandGUIDLen = 8
+)
+
 func (plugin *cniNetworkPlugin) syncNetworkConfig(ctx context.Context) error {
 	networks, defaultNetName, err := loadNetworks(ctx, plugin.confDir, plugin.cniConfig)
 	if err != nil {
@@ -417,6 +606,8 @@ func (plugin *cniNetworkPlugin) syncNetworkConfig(ctx context.Context) error {
 	plugin.Lock()
 	defer plugin.Unlock()
 
+	oldDefaultNet := plugin.networks[plugin.defaultNetName.name]
+
 	// Update defaultNetName if it is changeable
 	if plugin.defaultNetName.changeable {
 		plugin.defaultNetName.name = defaultNetName
@@ -430,6 +621,13 @@ func (plugin *cniNetworkPlugin) syncNetworkConfig(ctx context.Context) error {
 
 	plugin.networks = networks
 
+	// Drop the cached STATUS result if the default network changed
+	newDefaultNet := networks[plugin.defaultNetName.name]
+	if oldDefaultNet == nil || newDefaultNet == nil || oldDefaultNet.name != newDefaultNet.name ||
+		!bytes.Equal(oldDefaultNet.config.Bytes, newDefaultNet.config.Bytes) {
+		plugin.statusCache.invalidate()
+	}
+
 	return nil
 }
 
@@ -472,6 +670,23 @@ func (plugin *cniNetworkPlugin) Name() string {
 	return CNIPluginName
 }
 
+// errNotCached is returned when a network attachment is not in the CNI
+// cache.
+var errNotCached = errors.New("not found in CNI cache")
+
+// loadAttachmentFromCache loads the network config and runtime config of a
+// network attachment of a pod from the CNI cache.
+func (plugin *cniNetworkPlugin) loadAttachmentFromCache(podNetwork *PodNetwork, attachment *NetAttachment) (*cniNetwork, *libcni.RuntimeConf, error) {
+	// The cache restores the args and capability args, but not the network
+	// namespace
+	baseRt, err := buildCNIRuntimeConf(podNetwork, attachment, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return plugin.loadNetworkFromCache(attachment.Name, baseRt)
+}
+
 func (plugin *cniNetworkPlugin) loadNetworkFromCache(name string, rt *libcni.RuntimeConf) (*cniNetwork, *libcni.RuntimeConf, error) {
 	cniNet := &cniNetwork{
 		name: name,
@@ -488,7 +703,7 @@ func (plugin *cniNetworkPlugin) loadNetworkFromCache(name string, rt *libcni.Run
 	if err != nil {
 		return nil, nil, err
 	} else if confBytes == nil {
-		return nil, nil, fmt.Errorf("network %q not found in CNI cache", name)
+		return nil, nil, fmt.Errorf("network %q %w", name, errNotCached)
 	}
 
 	cniNet.config, err = libcni.NetworkConfFromBytes(confBytes)
@@ -511,7 +726,9 @@ func (plugin *cniNetworkPlugin) loadNetworkFromCache(name string, rt *libcni.Run
 
 // fillPodNetworks inserts any needed values in the set of pod network requests:
 // - if no networks, add default
-// - if no interface names, synthesize
+// - if no interface names, synthesize them according to the naming policy
+// - validate explicit interface names
+// - if no primary attachment, designate one
 //
 // plugin RLock must be held.
 func (plugin *cniNetworkPlugin) fillPodNetworks(podNetwork *PodNetwork) error {
@@ -521,10 +738,18 @@ func (plugin *cniNetworkPlugin) fillPodNetworks(podNetwork *PodNetwork) error {
 		})
 	}
 
+	if err := plugin.fillPrimaryNetwork(podNetwork); err != nil {
+		return err
+	}
+
 	allIfNames := make(map[string]bool)
 
 	for _, net := range podNetwork.Networks {
 		if net.Ifname != "" {
+			if err := validateIfname(net.Ifname); err != nil {
+				return fmt.Errorf("network %q: %w", net.Name, err)
+			}
+
 			// Make sure the requested name isn't already assigned
 			if allIfNames[net.Ifname] {
 				return fmt.Errorf("network %q requested interface name %q already assigned", net.Name, net.Ifname)
@@ -534,36 +759,72 @@ func (plugin *cniNetworkPlugin) fillPodNetworks(podNetwork *PodNetwork) error {
 		}
 	}
 
-netLoop:
 	for i, network := range podNetwork.Networks {
 		if network.Ifname == "" {
-			for j := range 10000 {
-				candidate := fmt.Sprintf("eth%d", j)
-				if !allIfNames[candidate] {
-					allIfNames[candidate] = true
-					podNetwork.Networks[i].Ifname = candidate
-
-					continue netLoop
-				}
+			candidate, err := plugin.synthesizeIfname(podNetwork, i, allIfNames)
+			if err != nil {
+				return err
 			}
 
-			return fmt.Errorf("failed to find free interface name for network %q", network.Name)
+			allIfNames[candidate] = true
+			podNetwork.Networks[i].Ifname = candidate
 		}
 	}
 
 	return nil
 }
 
-type forEachNetworkFn func(*cniNetwork, *PodNetwork, *libcni.RuntimeConf) error
+// fillPrimaryNetwork ensures that exactly one attachment of the pod is the
+// primary one. If none is marked as primary, the first attachment to the
+// default network is chosen, or the first attachment if the pod is not
+// attached to the default network.
+//
+// plugin RLock must be held.
+func (plugin *cniNetworkPlugin) fillPrimaryNetwork(podNetwork *PodNetwork) error {
+	primary := -1
 
-func (plugin *cniNetworkPlugin) forEachNetwork(ctx context.Context, podNetwork *PodNetwork, fromCache bool, actionFn forEachNetworkFn) error {
+	for i, net := range podNetwork.Networks {
+		if !net.Primary {
+			continue
+		}
+
+		if primary >= 0 {
+			return fmt.Errorf("networks %q and %q are both marked as primary", podNetwork.Networks[primary].Name, net.Name)
+		}
+
+		primary = i
+	}
+
+	if primary >= 0 {
+		return nil
+	}
+
+	primary = slices.IndexFunc(podNetwork.Networks, func(net NetAttachment) bool {
+		return net.Name == plugin.defaultNetName.name
+	})
+	if primary < 0 {
+		primary = 0
+	}
+
+	podNetwork.Networks[primary].Primary = true
+
+	return nil
+}
+
+type forEachNetworkFn func(*cniNetwork, *PodNetwork, *NetAttachment, *libcni.RuntimeConf) error
+
+// snapshotNetworks fills the pod network requests and returns the currently
+// loaded configuration of every requested network which is known. The plugin
+// lock is only held while taking the snapshot, so that the caller can execute
+// plugins without blocking configuration reloads.
+func (plugin *cniNetworkPlugin) snapshotNetworks(ctx context.Context, podNetwork *PodNetwork, fromCache bool) (map[string]*cniNetwork, error) {
 	plugin.RLock()
 	defer plugin.RUnlock()
 
 	if err := plugin.fillPodNetworks(podNetwork); err != nil {
 		logrus.Errorf("Error filling interface names: %v", err)
 
-		return err
+		return nil, err
 	}
 
 	if !fromCache {
@@ -589,39 +850,66 @@ func (plugin *cniNetworkPlugin) forEachNetwork(ctx context.Context, podNetwork *
 		}
 	}
 
-	for _, network := range podNetwork.Networks {
-		runtimeConfig := podNetwork.RuntimeConfig[network.Name]
+	networks := make(map[string]*cniNetwork, len(podNetwork.Networks))
 
-		rt, err := buildCNIRuntimeConf(podNetwork, network.Ifname, &runtimeConfig)
-		if err != nil {
-			logrus.Errorf("Error building CNI runtime config: %v", err)
+	for _, net := range podNetwork.Networks {
+		if cniNet, ok := plugin.networks[net.Name]; ok {
+			networks[net.Name] = cniNet
+		}
+	}
 
+	return networks, nil
+}
+
+func (plugin *cniNetworkPlugin) forEachNetwork(ctx context.Context, podNetwork *PodNetwork, fromCache bool, actionFn forEachNetworkFn) error {
+	networks, err := plugin.snapshotNetworks(ctx, podNetwork, fromCache)
+	if err != nil {
+		return err
+	}
+
+	if !fromCache {
+		if err := validateRuntimeConfigs(podNetwork); err != nil {
 			return err
 		}
 
-		var cniNet *cniNetwork
+		if err := validatePodStaticIPs(podNetwork, networks); err != nil {
+			return err
+		}
+	}
 
-		if fromCache {
-			var newRt *libcni.RuntimeConf
+	for _, network := range podNetwork.Networks {
+		var (
+			cniNet *cniNetwork
+			rt     *libcni.RuntimeConf
+		)
 
-			cniNet, newRt, err = plugin.loadNetworkFromCache(network.Name, rt)
+		if fromCache {
+			cniNet, rt, err = plugin.loadAttachmentFromCache(podNetwork, &network)
 			if err != nil {
 				logrus.Errorf("Error loading cached network config: %v", err)
 				logrus.Warnf("Falling back to loading from existing plugins on disk")
-			} else {
-				// Use the updated RuntimeConf
-				rt = newRt
 			}
 		}
 
 		if cniNet == nil {
-			cniNet = plugin.networks[network.Name]
+			cniNet = networks[network.Name]
 			if cniNet == nil {
 				return fmt.Errorf("failed to find requested network name %s", network.Name)
 			}
+
+			rt, err = buildCNIRuntimeConf(podNetwork, &network, podNetwork.runtimeConfigFor(&network), cniNet.capabilities())
+			if err != nil {
+				logrus.Errorf("Error building CNI runtime config: %v", err)
+
+				return err
+			}
+
+			rt.Args = append(rt.Args, plugin.envArgs()...)
 		}
 
-		if err := actionFn(cniNet, podNetwork, rt); err != nil {
+		setOperationNetwork(ctx, network.Name)
+
+		if err := actionFn(cniNet, podNetwork, &network, rt); err != nil {
 			return err
 		}
 	}
@@ -640,35 +928,87 @@ func (plugin *cniNetworkPlugin) SetUpPodWithContext(ctx context.Context, podNetw
 		return nil, err
 	}
 
+	if err := validateSysctls(podNetwork.Sysctls); err != nil {
+		return nil, err
+	}
+
 	plugin.gcLock.RLock()
 	defer plugin.gcLock.RUnlock()
 
-	plugin.podLock(&podNetwork)
+	ctx = plugin.podLock(&podNetwork).startOperation(ctx, OperationAdd)
 	defer plugin.podUnlock(&podNetwork)
 
+	unlock, err := plugin.podFileLock(&podNetwork)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	releaseHostPorts, err := plugin.reserveHostPorts(&podNetwork)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := plugin.setUpPodNetworks(ctx, &podNetwork)
+	if err != nil {
+		releaseHostPorts()
+
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// setUpPodNetworks sets the sysctls of the pod, sets up its loopback
+// interface and adds it to its networks. The pod lock must be held.
+func (plugin *cniNetworkPlugin) setUpPodNetworks(ctx context.Context, podNetwork *PodNetwork) ([]NetResult, error) {
+	// Sysctls are set before any plugin runs, including the loopback one
+	if err := applySysctls(podNetwork.NetNS, podNetwork.Sysctls); err != nil {
+		logrus.Error(err)
+
+		return nil, err
+	}
+
 	// Set up loopback interface
-	if err := bringUpLoopback(podNetwork.NetNS); err != nil {
+	if err := plugin.setUpLoopback(ctx, podNetwork); err != nil {
 		logrus.Error(err)
 
 		return nil, err
 	}
 
+	return plugin.addPodNetworks(ctx, podNetwork)
+}
+
+// addPodNetworks adds the pod to each of its networks. The pod lock must be
+// held.
+func (plugin *cniNetworkPlugin) addPodNetworks(ctx context.Context, podNetwork *PodNetwork) ([]NetResult, error) {
 	results := make([]NetResult, 0)
 
-	if err := plugin.forEachNetwork(ctx, &podNetwork, false, func(network *cniNetwork, podNetwork *PodNetwork, rt *libcni.RuntimeConf) error {
+	if err := plugin.forEachNetwork(ctx, podNetwork, false, func(network *cniNetwork, podNetwork *PodNetwork, attachment *NetAttachment, rt *libcni.RuntimeConf) error {
 		fullPodName := buildFullPodName(podNetwork)
 		logrus.Infof("Adding pod %s to CNI network %q (type=%v)", fullPodName, network.name, network.config.Plugins[0].Network.Type)
 
+		event := &HookEvent{Operation: OperationAdd, PodNetwork: podNetwork, Attachment: attachment, RuntimeConf: rt}
+		if err := runHooks(ctx, "pre", plugin.preHooks, event); err != nil {
+			return fmt.Errorf("error adding pod %s to CNI network %q: %w", fullPodName, network.name, err)
+		}
+
 		result, err := network.addToNetwork(ctx, rt, plugin.cniConfig)
 		if err != nil {
 			return fmt.Errorf("error adding pod %s to CNI network %q: %w", fullPodName, network.name, err)
 		}
 
+		event.Result = result
+		if err := runHooks(ctx, "post", plugin.postHooks, event); err != nil {
+			return fmt.Errorf("error adding pod %s to CNI network %q: %w", fullPodName, network.name, err)
+		}
+
 		results = append(results, NetResult{
 			Result: result,
 			NetAttachment: NetAttachment{
-				Name:   network.name,
-				Ifname: rt.IfName,
+				Name:    network.name,
+				Ifname:  rt.IfName,
+				Primary: attachment.Primary,
 			},
 		})
 
@@ -680,13 +1020,17 @@ func (plugin *cniNetworkPlugin) SetUpPodWithContext(ctx context.Context, podNetw
 	return results, nil
 }
 
-func (plugin *cniNetworkPlugin) getCachedNetworkInfo(containerID string) ([]NetAttachment, error) {
-	cacheDir := libcni.CacheDir
+// getCacheDir returns the CNI cache directory used by the plugin.
+func (plugin *cniNetworkPlugin) getCacheDir() string {
 	if plugin.cacheDir != "" {
-		cacheDir = plugin.cacheDir
+		return plugin.cacheDir
 	}
 
-	dirPath := filepath.Join(cacheDir, "results")
+	return libcni.CacheDir
+}
+
+func (plugin *cniNetworkPlugin) getCachedNetworkInfo(containerID string) ([]NetAttachment, error) {
+	dirPath := filepath.Join(plugin.getCacheDir(), "results")
 
 	entries, err := os.ReadDir(dirPath)
 	if err != nil {
@@ -742,7 +1086,7 @@ func (plugin *cniNetworkPlugin) getCachedNetworkInfo(containerID string) ([]NetA
 			continue
 		}
 		// Ignore the loopback interface; it's handled separately
-		if cachedInfo.IfName == loIfname && cachedInfo.NetName == "cni-loopback" {
+		if cachedInfo.IfName == loIfname && cachedInfo.NetName == loopbackNetName {
 			continue
 		}
 
@@ -761,6 +1105,17 @@ func (plugin *cniNetworkPlugin) getCachedNetworkInfo(containerID string) ([]NetA
 	return attachments, nil
 }
 
+// fillCachedNetworks uses the cached attachments of the pod if it does not
+// request any networks.
+func (plugin *cniNetworkPlugin) fillCachedNetworks(podNetwork *PodNetwork) {
+	if len(podNetwork.Networks) == 0 {
+		attachments, err := plugin.getCachedNetworkInfo(podNetwork.ID)
+		if err == nil && len(attachments) > 0 {
+			podNetwork.Networks = attachments
+		}
+	}
+}
+
 // TearDownPod tears down pod networks. Prefers cached pod attachment information
 // but falls back to given network attachment information.
 //
@@ -771,12 +1126,7 @@ func (plugin *cniNetworkPlugin) TearDownPod(podNetwork PodNetwork) error {
 
 //nolint:gocritic // would be an API change
 func (plugin *cniNetworkPlugin) TearDownPodWithContext(ctx context.Context, podNetwork PodNetwork) error {
-	if len(podNetwork.Networks) == 0 {
-		attachments, err := plugin.getCachedNetworkInfo(podNetwork.ID)
-		if err == nil && len(attachments) > 0 {
-			podNetwork.Networks = attachments
-		}
-	}
+	plugin.fillCachedNetworks(&podNetwork)
 
 	if err := plugin.networksAvailable(&podNetwork); err != nil {
 		return err
@@ -785,10 +1135,26 @@ func (plugin *cniNetworkPlugin) TearDownPodWithContext(ctx context.Context, podN
 	plugin.gcLock.RLock()
 	defer plugin.gcLock.RUnlock()
 
-	plugin.podLock(&podNetwork)
+	ctx = plugin.podLock(&podNetwork).startOperation(ctx, OperationDel)
 	defer plugin.podUnlock(&podNetwork)
 
-	return plugin.forEachNetwork(ctx, &podNetwork, true, func(network *cniNetwork, podNetwork *PodNetwork, rt *libcni.RuntimeConf) error {
+	unlock, err := plugin.podFileLock(&podNetwork)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := plugin.deletePodNetworks(ctx, &podNetwork); err != nil {
+		return err
+	}
+
+	return plugin.tearDownLoopback(ctx, &podNetwork)
+}
+
+// deletePodNetworks deletes the pod from each of its networks, preferring the
+// cached network configuration. The pod lock must be held.
+func (plugin *cniNetworkPlugin) deletePodNetworks(ctx context.Context, podNetwork *PodNetwork) error {
+	return plugin.forEachNetwork(ctx, podNetwork, true, func(network *cniNetwork, podNetwork *PodNetwork, attachment *NetAttachment, rt *libcni.RuntimeConf) error {
 		fullPodName := buildFullPodName(podNetwork)
 
 		networkType := "unknown"
@@ -798,10 +1164,21 @@ func (plugin *cniNetworkPlugin) TearDownPodWithContext(ctx context.Context, podN
 
 		logrus.Infof("Deleting pod %s from CNI network %q (type=%v)", fullPodName, network.name, networkType)
 
+		event := &HookEvent{Operation: OperationDel, PodNetwork: podNetwork, Attachment: attachment, RuntimeConf: rt}
+		if err := runHooks(ctx, "pre", plugin.preHooks, event); err != nil {
+			return fmt.Errorf("error removing pod %s from CNI network %q: %w", fullPodName, network.name, err)
+		}
+
 		if err := network.deleteFromNetwork(ctx, rt, plugin.cniConfig); err != nil {
 			return fmt.Errorf("error removing pod %s from CNI network %q: %w", fullPodName, network.name, err)
 		}
 
+		plugin.hostPorts.release(podNetwork.ID, attachment.Name, rt.IfName)
+
+		if err := runHooks(ctx, "post", plugin.postHooks, event); err != nil {
+			logrus.Warnf("Ignoring error after removing pod %s from CNI network %q: %v", fullPodName, network.name, err)
+		}
+
 		return nil
 	})
 }
@@ -819,10 +1196,16 @@ func (plugin *cniNetworkPlugin) GetPodNetworkStatus(podNetwork PodNetwork) ([]Ne
 //
 //nolint:gocritic // would be an API change
 func (plugin *cniNetworkPlugin) GetPodNetworkStatusWithContext(ctx context.Context, podNetwork PodNetwork) ([]NetResult, error) {
-	plugin.podLock(&podNetwork)
+	ctx = plugin.podLock(&podNetwork).startOperation(ctx, OperationCheck)
 	defer plugin.podUnlock(&podNetwork)
 
-	if err := checkLoopback(podNetwork.NetNS); err != nil {
+	unlock, err := plugin.podFileLock(&podNetwork)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := plugin.checkPodLoopback(ctx, &podNetwork); err != nil {
 		logrus.Error(err)
 
 		return nil, err
@@ -830,21 +1213,19 @@ func (plugin *cniNetworkPlugin) GetPodNetworkStatusWithContext(ctx context.Conte
 
 	results := make([]NetResult, 0)
 
-	if err := plugin.forEachNetwork(ctx, &podNetwork, true, func(network *cniNetwork, podNetwork *PodNetwork, rt *libcni.RuntimeConf) error {
-		fullPodName := buildFullPodName(podNetwork)
-		logrus.Infof("Checking pod %s for CNI network %s (type=%v)", fullPodName, network.name, network.config.Plugins[0].Network.Type)
-
-		result, err := network.checkNetwork(ctx, rt, plugin.cniConfig, plugin.nsManager, podNetwork.NetNS)
+	if err := plugin.forEachNetwork(ctx, &podNetwork, true, func(network *cniNetwork, podNetwork *PodNetwork, attachment *NetAttachment, rt *libcni.RuntimeConf) error {
+		result, err := plugin.checkAttachment(ctx, network, podNetwork, attachment, rt)
 		if err != nil {
-			return fmt.Errorf("error checking pod %s for CNI network %q: %w", fullPodName, network.name, err)
+			return err
 		}
 
 		if result != nil {
 			results = append(results, NetResult{
 				Result: result,
 				NetAttachment: NetAttachment{
-					Name:   network.name,
-					Ifname: rt.IfName,
+					Name:    network.name,
+					Ifname:  rt.IfName,
+					Primary: attachment.Primary,
 				},
 			})
 		}
@@ -857,15 +1238,60 @@ func (plugin *cniNetworkPlugin) GetPodNetworkStatusWithContext(ctx context.Conte
 	return results, nil
 }
 
+// checkAttachment checks a network attachment of a pod, calling the hooks
+// around the check.
+func (plugin *cniNetworkPlugin) checkAttachment(ctx context.Context, network *cniNetwork, podNetwork *PodNetwork, attachment *NetAttachment, rt *libcni.RuntimeConf) (cnitypes.Result, error) {
+	fullPodName := buildFullPodName(podNetwork)
+	logrus.Infof("Checking pod %s for CNI network %s (type=%v)", fullPodName, network.name, network.config.Plugins[0].Network.Type)
+
+	event := &HookEvent{Operation: OperationCheck, PodNetwork: podNetwork, Attachment: attachment, RuntimeConf: rt}
+	if err := runHooks(ctx, "pre", plugin.preHooks, event); err != nil {
+		return nil, fmt.Errorf("error checking pod %s for CNI network %q: %w", fullPodName, network.name, err)
+	}
+
+	result, err := network.checkNetwork(ctx, rt, plugin.cniConfig, podNetwork.NetNS)
+	if err != nil {
+		return nil, fmt.Errorf("error checking pod %s for CNI network %q: %w", fullPodName, network.name, err)
+	}
+
+	event.Result = result
+	if err := runHooks(ctx, "post", plugin.postHooks, event); err != nil {
+		return nil, fmt.Errorf("error checking pod %s for CNI network %q: %w", fullPodName, network.name, err)
+	}
+
+	return result, nil
+}
+
 // GC cleans up any stale attachments.
 // It preserves all attachments and resources belonging to pods in `validPods`. A CNI
 // DEL command will be issued for all known cached attachments, then a CNI GC (for CNI
-// v1.1 and higher) for any straggling resources.
+// v1.1 and higher) for any straggling resources. Loopback attachments are
+// collected as well if the CNI loopback plugin is used.
 func (plugin *cniNetworkPlugin) GC(ctx context.Context, validPods []*PodNetwork) error {
 	// Must always acquire gcLock before plugin lock.
 	plugin.gcLock.Lock()
 	defer plugin.gcLock.Unlock()
 
+	plugin.gcRunning.Store(true)
+	defer plugin.gcRunning.Store(false)
+
+	validIDs := make(map[string]bool, len(validPods))
+	for _, pod := range validPods {
+		validIDs[pod.ID] = true
+	}
+
+	if plugin.fileLocker != nil {
+		gcLock, err := plugin.fileLocker.lockGC(true)
+		if err != nil {
+			return err
+		}
+		defer gcLock.unlock()
+
+		defer plugin.fileLocker.removeStale(validIDs)
+	}
+
+	plugin.hostPorts.retain(validIDs)
+
 	// Lock plugin, so we can read config fields.
 	plugin.RLock()
 	defer plugin.RUnlock()
@@ -873,8 +1299,20 @@ func (plugin *cniNetworkPlugin) GC(ctx context.Context, validPods []*PodNetwork)
 	// for every network, determine the set of valid attachments -- (ID, ifname) pairs
 	validAttachments := map[string][]cnitypes.GCAttachment{}
 
+	// Networks of pods whose attachments are unknown must not be GCed, as
+	// that could remove resources of valid attachments
+	skippedNetworks := map[string]bool{}
+
 	for _, pod := range validPods {
-		_ = plugin.fillPodNetworks(pod) // cannot have error here; or else pod could not have been ADDed
+		if err := plugin.fillPodNetworks(pod); err != nil {
+			logrus.Warnf("Skipping GC of the CNI networks of pod %s: %v", buildFullPodName(pod), err)
+
+			for _, network := range pod.Networks {
+				skippedNetworks[network.Name] = true
+			}
+
+			continue
+		}
 
 		for _, network := range pod.Networks {
 			validAttachments[network.Name] = append(validAttachments[network.Name], cnitypes.GCAttachment{
@@ -888,6 +1326,10 @@ func (plugin *cniNetworkPlugin) GC(ctx context.Context, validPods []*PodNetwork)
 	var result error
 
 	for netname, network := range plugin.networks {
+		if skippedNetworks[netname] {
+			continue
+		}
+
 		args := &libcni.GCArgs{
 			ValidAttachments: validAttachments[netname],
 		}
@@ -899,6 +1341,11 @@ func (plugin *cniNetworkPlugin) GC(ctx context.Context, validPods []*PodNetwork)
 		}
 	}
 
+	if err := plugin.gcLoopback(ctx, validPods); err != nil {
+		logrus.Warnf("Error while GCing network %s: %v", loopbackNetName, err)
+		result = errors.Join(result, err)
+	}
+
 	return result
 }
 
@@ -906,7 +1353,7 @@ func (network *cniNetwork) addToNetwork(ctx context.Context, rt *libcni.RuntimeC
 	return cni.AddNetworkList(ctx, network.config, rt)
 }
 
-func (network *cniNetwork) checkNetwork(ctx context.Context, rt *libcni.RuntimeConf, cni *libcni.CNIConfig, nsManager *nsManager, netns string) (cnitypes.Result, error) {
+func (network *cniNetwork) checkNetwork(ctx context.Context, rt *libcni.RuntimeConf, cni *libcni.CNIConfig, netns string) (cnitypes.Result, error) {
 	gtet, err := cniversion.GreaterThanOrEqualTo(network.config.CNIVersion, "0.4.0")
 	if err != nil {
 		return nil, err
@@ -936,35 +1383,36 @@ func (network *cniNetwork) checkNetwork(ctx context.Context, rt *libcni.RuntimeC
 	}
 
 	// result doesn't exist, create one
-	logrus.Infof("Checking CNI network %s (config version=%v) nsManager=%v", network.name, network.config.CNIVersion, nsManager)
+	logrus.Infof("Checking CNI network %s (config version=%v) without cached result", network.name, network.config.CNIVersion)
 
-	var cniInterface *cniv1.Interface
+	status, err := getLiveInterfaceStatus(ctx, netns, rt.IfName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve network status: %w", err)
+	}
 
-	ips := []*cniv1.IPConfig{}
-	errs := []error{}
+	// The addresses are still reported for interfaces which are down, the
+	// live status reports their link state
+	if !status.Up {
+		logrus.Warnf("Interface %s of CNI network %q is down", rt.IfName, network.name)
+	}
 
-	for _, version := range []string{"4", "6"} {
-		ip, mac, err := getContainerDetails(ctx, nsManager, netns, rt.IfName, "-"+version)
-		if err == nil {
-			if cniInterface == nil {
-				cniInterface = &cniv1.Interface{
-					Name:    rt.IfName,
-					Mac:     mac.String(),
-					Sandbox: netns,
-				}
-			}
+	if len(status.IPs) == 0 {
+		return nil, errors.New("neither IPv4 nor IPv6 found when retrieving network status")
+	}
 
-			ips = append(ips, &cniv1.IPConfig{
-				Interface: cniv1.Int(0),
-				Address:   *ip,
-			})
-		} else {
-			errs = append(errs, err)
-		}
+	cniInterface := &cniv1.Interface{
+		Name:    rt.IfName,
+		Mac:     status.MAC,
+		Mtu:     status.MTU,
+		Sandbox: netns,
 	}
 
-	if cniInterface == nil || len(ips) == 0 {
-		return nil, fmt.Errorf("neither IPv4 nor IPv6 found when retrieving network status: %w", errors.Join(errs...))
+	ips := make([]*cniv1.IPConfig, 0, len(status.IPs))
+	for _, ip := range status.IPs {
+		ips = append(ips, &cniv1.IPConfig{
+			Interface: cniv1.Int(0),
+			Address:   *ip,
+		})
 	}
 
 	result = &cniv1.Result{
@@ -994,7 +1442,207 @@ func (network *cniNetwork) gcNetwork(ctx context.Context, cni *libcni.CNIConfig,
 	return cni.GCNetworkList(ctx, network.config, gcArgs)
 }
 
-func buildCNIRuntimeConf(podNetwork *PodNetwork, ifName string, runtimeConfig *RuntimeConfig) (*libcni.RuntimeConf, error) {
+// attachmentConfigFor returns the configuration specific to an attachment of
+// the pod.
+func (podNetwork *PodNetwork) attachmentConfigFor(attachment *NetAttachment) NetAttachmentConfig {
+	return podNetwork.AttachmentConfig[NetAttachmentKey{Name: attachment.Name, Ifname: attachment.Ifname}]
+}
+
+// runtimeConfigFor returns the runtime configuration of an attachment of the
+// pod, falling back to the configuration of its network.
+func (podNetwork *PodNetwork) runtimeConfigFor(attachment *NetAttachment) *RuntimeConfig {
+	if runtimeConfig := podNetwork.attachmentConfigFor(attachment).RuntimeConfig; runtimeConfig != nil {
+		return runtimeConfig
+	}
+
+	runtimeConfig := podNetwork.RuntimeConfig[attachment.Name]
+
+	return &runtimeConfig
+}
+
+// validateRuntimeConfigs ensures that every network-keyed runtime
+// configuration of the pod belongs to a network the pod is attached to, that
+// every attachment configuration belongs to an attachment of the pod, and
+// that the port mappings of the pod are valid.
+func validateRuntimeConfigs(podNetwork *PodNetwork) error {
+	for name := range podNetwork.RuntimeConfig {
+		if !slices.ContainsFunc(podNetwork.Networks, func(attachment NetAttachment) bool {
+			return attachment.Name == name
+		}) {
+			return fmt.Errorf("runtime config given for network %q which is not attached to pod %s", name, buildFullPodName(podNetwork))
+		}
+	}
+
+	for key := range podNetwork.AttachmentConfig {
+		if !slices.ContainsFunc(podNetwork.Networks, func(attachment NetAttachment) bool {
+			return attachment.Name == key.Name && attachment.Ifname == key.Ifname
+		}) {
+			return fmt.Errorf("attachment config given for interface %q of network %q which is not attached to pod %s",
+				key.Ifname, key.Name, buildFullPodName(podNetwork))
+		}
+	}
+
+	return validatePodPortMappings(podNetwork)
+}
+
+// capabilities returns the capabilities declared by any of the plugins of
+// the network.
+func (network *cniNetwork) capabilities() map[string]bool {
+	capabilities := map[string]bool{}
+
+	if network.config == nil {
+		return capabilities
+	}
+
+	for _, plugin := range network.config.Plugins {
+		if plugin.Network == nil {
+			continue
+		}
+
+		for capability, enabled := range plugin.Network.Capabilities {
+			if enabled {
+				capabilities[capability] = true
+			}
+		}
+	}
+
+	return capabilities
+}
+
+// staticIPs returns the static IPs requested by a runtime config, ensuring
+// that there is at most one address per IP family.
+func staticIPs(runtimeConfig *RuntimeConfig) ([]string, error) {
+	if runtimeConfig.IP != "" {
+		if len(runtimeConfig.IPs) > 0 {
+			return nil, errors.New("static IPs must be given either as IP or as IPs")
+		}
+
+		if net.ParseIP(runtimeConfig.IP) == nil {
+			return nil, fmt.Errorf("unable to parse IP address %q", runtimeConfig.IP)
+		}
+
+		return []string{runtimeConfig.IP}, nil
+	}
+
+	var hasIPv4, hasIPv6 bool
+
+	for _, ip := range runtimeConfig.IPs {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			var err error
+
+			parsed, _, err = net.ParseCIDR(ip)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse IP address %q", ip)
+			}
+		}
+
+		if parsed.To4() != nil {
+			if hasIPv4 {
+				return nil, fmt.Errorf("more than one static IPv4 address in %v", runtimeConfig.IPs)
+			}
+
+			hasIPv4 = true
+		} else {
+			if hasIPv6 {
+				return nil, fmt.Errorf("more than one static IPv6 address in %v", runtimeConfig.IPs)
+			}
+
+			hasIPv6 = true
+		}
+	}
+
+	return runtimeConfig.IPs, nil
+}
+
+// isReservedArg reports whether a CNI_ARGS key is set by ocicni.
+func isReservedArg(key string) bool {
+	switch key {
+	case "IgnoreUnknown", "K8S_POD_NAMESPACE", "K8S_POD_NAME",
+		"K8S_POD_INFRA_CONTAINER_ID", "K8S_POD_UID", "IP", "MAC":
+		return true
+	}
+
+	return false
+}
+
+// validateArgs checks that the extra CNI_ARGS of a pod and an attachment can
+// be encoded, and that no key is set twice or collides with a key set by
+// ocicni.
+func validateArgs(argLists ...[][2]string) error {
+	seen := map[string]bool{}
+
+	for _, args := range argLists {
+		for _, arg := range args {
+			key, value := arg[0], arg[1]
+
+			if key == "" || strings.ContainsAny(key, ";=") {
+				return fmt.Errorf("invalid CNI_ARGS key %q", key)
+			}
+
+			if strings.ContainsAny(value, ";=") {
+				return fmt.Errorf("invalid value %q of CNI_ARGS key %q", value, key)
+			}
+
+			if isReservedArg(key) {
+				return fmt.Errorf("CNI_ARGS key %q is set by ocicni", key)
+			}
+
+			if seen[key] {
+				return fmt.Errorf("duplicate CNI_ARGS key %q", key)
+			}
+
+			seen[key] = true
+		}
+	}
+
+	return nil
+}
+
+// envArgs returns the CNI_ARGS of the environment of the process, if they
+// are propagated to the plugins.
+func (plugin *cniNetworkPlugin) envArgs() [][2]string {
+	if !plugin.propagateEnvArgs {
+		return nil
+	}
+
+	args := [][2]string{}
+
+	for kvpairs := range strings.SplitSeq(os.Getenv("CNI_ARGS"), ";") {
+		if keyval := strings.SplitN(kvpairs, "=", keyValuePairLen); len(keyval) == keyValuePairLen {
+			args = append(args, [2]string{keyval[0], keyval[1]})
+		}
+	}
+
+	return args
+}
+
+// isReservedCapability reports whether capability is set from one of the
+// fields of RuntimeConfig or PodNetwork.
+func isReservedCapability(capability string) bool {
+	switch capability {
+	case capabilityPortMappings, capabilityBandwidth, capabilityIPRanges,
+		capabilityIPs, capabilityAliases, capabilityCgroupPath,
+		capabilityPodAnnotations, capabilityDNS, capabilityMAC,
+		capabilityDeviceID, capabilityInfinibandGUID:
+		return true
+	}
+
+	return false
+}
+
+// isPCIAddress reports whether address is a PCI address in the extended
+// domain:bus:device.function form, like "0000:03:00.1".
+func isPCIAddress(address string) bool {
+	matched, err := regexp.MatchString(pciAddressPattern, address)
+
+	return err == nil && matched
+}
+
+// buildCNIRuntimeConf builds the runtime config of an attachment. The
+// capabilities of the network determine how some settings are passed to the
+// plugins.
+func buildCNIRuntimeConf(podNetwork *PodNetwork, attachment *NetAttachment, runtimeConfig *RuntimeConfig, capabilities map[string]bool) (*libcni.RuntimeConf, error) {
 	if runtimeConfig == nil {
 		runtimeConfig = &RuntimeConfig{}
 	}
@@ -1004,7 +1652,7 @@ func buildCNIRuntimeConf(podNetwork *PodNetwork, ifName string, runtimeConfig *R
 	rt := &libcni.RuntimeConf{
 		ContainerID: podNetwork.ID,
 		NetNS:       podNetwork.NetNS,
-		IfName:      ifName,
+		IfName:      attachment.Ifname,
 		Args: [][2]string{
 			{"IgnoreUnknown", "1"},
 			{"K8S_POD_NAMESPACE", podNetwork.Namespace},
@@ -1015,42 +1663,82 @@ func buildCNIRuntimeConf(podNetwork *PodNetwork, ifName string, runtimeConfig *R
 		CapabilityArgs: map[string]any{},
 	}
 
-	// Propagate existing CNI_ARGS to non-k8s consumers
-	for kvpairs := range strings.SplitSeq(os.Getenv("CNI_ARGS"), ";") {
-		if keyval := strings.SplitN(kvpairs, "=", keyValuePairLen); len(keyval) == keyValuePairLen {
-			rt.Args = append(rt.Args, [2]string{keyval[0], keyval[1]})
-		}
+	// Add the pod and attachment specific args to CNI_ARGS
+	attachmentArgs := podNetwork.attachmentConfigFor(attachment).Args
+	if err := validateArgs(podNetwork.Args, attachmentArgs); err != nil {
+		return nil, err
 	}
 
-	// Add requested static IP to CNI_ARGS
-	ip := runtimeConfig.IP
-	if ip != "" {
-		if tstIP := net.ParseIP(ip); tstIP == nil {
-			return nil, fmt.Errorf("unable to parse IP address %q", ip)
-		}
+	rt.Args = append(rt.Args, podNetwork.Args...)
+	rt.Args = append(rt.Args, attachmentArgs...)
+
+	// Add requested static IPs, using CNI_ARGS if the network does not
+	// support the ips capability
+	ips, err := staticIPs(runtimeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ips) > 0 {
+		if capabilities[capabilityIPs] {
+			rt.CapabilityArgs[capabilityIPs] = ips
+		} else {
+			addrs := make([]string, 0, len(ips))
+			for _, ip := range ips {
+				addr, _, _ := strings.Cut(ip, "/")
+				addrs = append(addrs, addr)
+			}
 
-		rt.Args = append(rt.Args, [2]string{"IP", ip})
+			rt.Args = append(rt.Args, [2]string{"IP", strings.Join(addrs, ",")})
+		}
 	}
 
-	// Add the requested static MAC to CNI_ARGS
+	// Add the requested static MAC, using CNI_ARGS if the network does not
+	// support the mac capability
 	mac := runtimeConfig.MAC
 	if mac != "" {
-		_, err := net.ParseMAC(mac)
-		if err != nil {
+		if _, err := net.ParseMAC(mac); err != nil {
 			return nil, fmt.Errorf("unable to parse MAC address %q: %w", mac, err)
 		}
 
-		rt.Args = append(rt.Args, [2]string{"MAC", mac})
+		if capabilities[capabilityMAC] {
+			rt.CapabilityArgs[capabilityMAC] = mac
+		} else {
+			rt.Args = append(rt.Args, [2]string{"MAC", mac})
+		}
+	}
+
+	// Set DeviceID in Capabilities
+	if deviceID := runtimeConfig.DeviceID; deviceID != "" {
+		if !isPCIAddress(deviceID) {
+			return nil, fmt.Errorf("invalid device ID %q: not a PCI address", deviceID)
+		}
+
+		rt.CapabilityArgs[capabilityDeviceID] = deviceID
+	}
+
+	// Set InfinibandGUID in Capabilities
+	if guid := runtimeConfig.InfinibandGUID; guid != "" {
+		if hw, err := net.ParseMAC(guid); err != nil || len(hw) != infinibandGUIDLen {
+			return nil, fmt.Errorf("invalid InfiniBand GUID %q", guid)
+		}
+
+		rt.CapabilityArgs[capabilityInfinibandGUID] = guid
 	}
 
 	// Set PortMappings in Capabilities
 	if len(runtimeConfig.PortMappings) != 0 {
-		rt.CapabilityArgs["portMappings"] = runtimeConfig.PortMappings
+		portMappings, err := normalizePortMappings(runtimeConfig.PortMappings, ips)
+		if err != nil {
+			return nil, err
+		}
+
+		rt.CapabilityArgs[capabilityPortMappings] = portMappings
 	}
 
 	// Set Bandwidth in Capabilities
 	if runtimeConfig.Bandwidth != nil {
-		rt.CapabilityArgs["bandwidth"] = map[string]uint64{
+		rt.CapabilityArgs[capabilityBandwidth] = map[string]uint64{
 			"ingressRate":  runtimeConfig.Bandwidth.IngressRate,
 			"ingressBurst": runtimeConfig.Bandwidth.IngressBurst,
 			"egressRate":   runtimeConfig.Bandwidth.EgressRate,
@@ -1060,22 +1748,52 @@ func buildCNIRuntimeConf(podNetwork *PodNetwork, ifName string, runtimeConfig *R
 
 	// Set IpRanges in Capabilities
 	if len(runtimeConfig.IpRanges) > 0 {
-		rt.CapabilityArgs["ipRanges"] = runtimeConfig.IpRanges
+		rt.CapabilityArgs[capabilityIPRanges] = runtimeConfig.IpRanges
 	}
 
 	// Set Aliases in Capabilities
 	if len(podNetwork.Aliases) > 0 {
-		rt.CapabilityArgs["aliases"] = podNetwork.Aliases
+		rt.CapabilityArgs[capabilityAliases] = podNetwork.Aliases
 	}
 
 	// set cgroupPath in Capabilities
 	if runtimeConfig.CgroupPath != "" {
-		rt.CapabilityArgs["cgroupPath"] = runtimeConfig.CgroupPath
+		rt.CapabilityArgs[capabilityCgroupPath] = runtimeConfig.CgroupPath
+	}
+
+	// Set DNS in Capabilities
+	if dns := runtimeConfig.DNS; dns != nil {
+		dnsArgs := map[string][]string{}
+
+		if len(dns.Servers) > 0 {
+			dnsArgs["servers"] = dns.Servers
+		}
+
+		if len(dns.Searches) > 0 {
+			dnsArgs["searches"] = dns.Searches
+		}
+
+		if len(dns.Options) > 0 {
+			dnsArgs["options"] = dns.Options
+		}
+
+		if len(dnsArgs) > 0 {
+			rt.CapabilityArgs[capabilityDNS] = dnsArgs
+		}
 	}
 
 	// Set PodAnnotations in Capabilities
 	if runtimeConfig.PodAnnotations != nil {
-		rt.CapabilityArgs["io.kubernetes.cri.pod-annotations"] = runtimeConfig.PodAnnotations
+		rt.CapabilityArgs[capabilityPodAnnotations] = runtimeConfig.PodAnnotations
+	}
+
+	// Add the additional capability args
+	for capability, value := range runtimeConfig.CapabilityArgs {
+		if isReservedCapability(capability) {
+			return nil, fmt.Errorf("capability %q is set by ocicni and cannot be passed in CapabilityArgs", capability)
+		}
+
+		rt.CapabilityArgs[capability] = value
 	}
 
 	return rt, nil
@@ -1093,5 +1811,7 @@ func (plugin *cniNetworkPlugin) StatusWithContext(ctx context.Context) error {
 		return fmt.Errorf(errMissingDefaultNetwork, plugin.confDir)
 	}
 
-	return defaultNet.getNetworkStatus(ctx, plugin.cniConfig)
+	return plugin.statusCache.get(ctx, plugin.statusTimeout, func(ctx context.Context) error {
+		return defaultNet.getNetworkStatus(ctx, plugin.cniConfig)
+	})
 }
@@ -0,0 +1,142 @@
+package ocicni
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/sirupsen/logrus"
+)
+
+// benchParallelism is the number of goroutines per CPU used by the parallel
+// benchmarks, which results in thousands of concurrent pods.
+const benchParallelism = 256
+
+// benchExec is a fake exec which succeeds every command without checking
+// its input, so it can be used from many goroutines at once.
+type benchExec struct {
+	version.PluginDecoder
+}
+
+func (*benchExec) ExecPlugin(_ context.Context, _ string, _ []byte, environ []string) ([]byte, error) {
+	cmd, err := getCNICommand(environ)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case "VERSION":
+		return json.Marshal(version.All)
+	case "ADD":
+		return []byte(`{"cniVersion": "1.0.0"}`), nil
+	default:
+		return nil, nil
+	}
+}
+
+func (*benchExec) FindInPath(plugin string, paths []string) (string, error) {
+	return filepath.Join(paths[0], plugin), nil
+}
+
+func newBenchPlugin(b *testing.B) (*cniNetworkPlugin, ns.NetNS) {
+	b.Helper()
+
+	// Avoid flooding the output with per-pod log messages
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	b.Cleanup(func() {
+		logrus.SetLevel(level)
+	})
+
+	netNS, err := testutils.NewNS()
+	if err != nil {
+		b.Skipf("unable to create network namespace: %v", err)
+	}
+
+	b.Cleanup(func() {
+		_ = netNS.Close()
+		_ = testutils.UnmountNS(netNS)
+	})
+
+	confDir := b.TempDir()
+	if _, _, err := writeConfig(confDir, "10-bench.conf", "bench", "myplugin", "1.0.0"); err != nil {
+		b.Fatal(err)
+	}
+
+	plugin, err := initCNI(&benchExec{}, b.TempDir(), "bench", confDir, false, "/opt/cni/bin")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Cleanup(func() {
+		_ = plugin.Shutdown()
+	})
+
+	cniPlugin, ok := plugin.(*cniNetworkPlugin)
+	if !ok {
+		b.Fatal("unexpected plugin type")
+	}
+
+	return cniPlugin, netNS
+}
+
+// BenchmarkPodLock measures lock throughput with thousands of concurrent pods.
+func BenchmarkPodLock(b *testing.B) {
+	plugin, _ := newBenchPlugin(b)
+
+	var podIndex atomic.Int64
+
+	b.SetParallelism(benchParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		podNet := &PodNetwork{
+			Namespace: "bench",
+			Name:      fmt.Sprintf("pod%d", podIndex.Add(1)),
+		}
+
+		for pb.Next() {
+			plugin.podLock(podNet)
+			plugin.podUnlock(podNet)
+		}
+	})
+}
+
+// BenchmarkSetUpTearDownPod measures the throughput of pod setup and teardown
+// with thousands of concurrent pods.
+func BenchmarkSetUpTearDownPod(b *testing.B) {
+	plugin, netNS := newBenchPlugin(b)
+
+	var podIndex atomic.Int64
+
+	b.SetParallelism(benchParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		index := podIndex.Add(1)
+		podNet := PodNetwork{
+			Namespace: "bench",
+			Name:      fmt.Sprintf("pod%d", index),
+			ID:        fmt.Sprintf("container%d", index),
+			NetNS:     netNS.Path(),
+		}
+
+		for pb.Next() {
+			if _, err := plugin.SetUpPod(podNet); err != nil {
+				b.Error(err)
+
+				return
+			}
+
+			if err := plugin.TearDownPod(podNet); err != nil {
+				b.Error(err)
+
+				return
+			}
+		}
+	})
+}
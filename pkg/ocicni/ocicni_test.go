@@ -6,12 +6,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containernetworking/cni/libcni"
@@ -62,6 +64,8 @@ type fakePlugin struct {
 	expectedConf string
 	result       types.Result
 	err          error
+	// If set, the plugin blocks until the channel is closed
+	wait chan struct{}
 }
 
 type fakeExec struct {
@@ -77,6 +81,10 @@ type fakeExec struct {
 	failFind bool
 
 	failStatus bool
+	// Per plugin type STATUS results, if set
+	statusFns map[string]func(ctx context.Context) error
+	// CHECK results by container ID and network namespace, if set
+	checkFn func(containerID, netns string) error
 }
 
 type TestConf struct {
@@ -167,7 +175,25 @@ func (f *fakeExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData
 			return nil, errors.New("status fails")
 		}
 
+		if statusFn, ok := f.statusFns[filepath.Base(pluginPath)]; ok {
+			return nil, statusFn(ctx)
+		}
+
 		return nil, nil
+	case "CHECK":
+		if f.checkFn != nil {
+			var containerID, netns string
+
+			for _, e := range environ {
+				if value, ok := strings.CutPrefix(e, "CNI_CONTAINERID="); ok {
+					containerID = value
+				} else if value, ok := strings.CutPrefix(e, "CNI_NETNS="); ok {
+					netns = value
+				}
+			}
+
+			return nil, f.checkFn(containerID, netns)
+		}
 	}
 
 	plugin := f.nextPlugin(cmd)
@@ -190,6 +216,10 @@ func (f *fakeExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData
 		matchArray(plugin.expectedEnv, environ)
 	}
 
+	if plugin.wait != nil {
+		<-plugin.wait
+	}
+
 	if plugin.err != nil {
 		return nil, plugin.err
 	}
@@ -456,6 +486,183 @@ var _ = Describe("ocicni operations", func() {
 		Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
 	})
 
+	It("reports the status of all networks", func() {
+		for _, network := range [][]string{
+			{"10-ready.conf", "ready", "readyplugin", "1.1.0"},
+			{"20-broken.conf", "broken", "brokenplugin", "1.1.0"},
+			{"30-hanging.conf", "hanging", "hangingplugin", "1.1.0"},
+			{"40-old.conf", "old", "oldplugin", "0.4.0"},
+		} {
+			_, _, err := writeConfig(tmpDir, network[0], network[1], network[2], network[3])
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		fake := &fakeExec{statusFns: map[string]func(ctx context.Context) error{
+			"brokenplugin": func(context.Context) error {
+				return errors.New("IPAM daemon is down")
+			},
+			"hangingplugin": func(ctx context.Context) error {
+				<-ctx.Done()
+
+				return ctx.Err()
+			},
+			"oldplugin": func(context.Context) error {
+				Fail("STATUS invoked for an unsupported version")
+
+				return nil
+			},
+		}}
+
+		_, err := newCNIPlugin(fake, cacheDir, "ready", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithStatusTimeout(0)})
+		Expect(err).To(MatchError("invalid status timeout 0s"))
+
+		ocicni, err := newCNIPlugin(fake, cacheDir, "ready", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithStatusTimeout(100 * time.Millisecond)})
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		// Only the default network is checked by Status
+		Expect(ocicni.Status()).To(Succeed())
+
+		reporter, ok := ocicni.(NetworkStatusReporter)
+		Expect(ok).To(BeTrue())
+
+		statuses := reporter.StatusAll(context.Background())
+		Expect(statuses).To(HaveLen(4))
+		Expect(statuses["ready"]).To(Equal(NetworkStatus{State: NetworkReady}))
+		Expect(statuses["old"]).To(Equal(NetworkStatus{State: NetworkStatusUnsupported}))
+		Expect(statuses["broken"].State).To(Equal(NetworkNotReady))
+		Expect(statuses["broken"].Err).To(MatchError(ContainSubstring("IPAM daemon is down")))
+		Expect(statuses["hanging"].State).To(Equal(NetworkNotReady))
+		Expect(statuses["hanging"].Err).To(MatchError(ContainSubstring("timed out after 100ms")))
+	})
+
+	It("caches the status of the default network", func() {
+		_, confPath, err := writeConfig(tmpDir, "10-test.conf", "test", "myplugin", "1.1.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		var (
+			invocations atomic.Int32
+			statusErr   atomic.Pointer[error]
+		)
+
+		release := make(chan struct{})
+		fake := &fakeExec{statusFns: map[string]func(ctx context.Context) error{
+			"myplugin": func(context.Context) error {
+				invocations.Add(1)
+				<-release
+
+				if err := statusErr.Load(); err != nil {
+					return *err
+				}
+
+				return nil
+			},
+		}}
+
+		_, err = newCNIPlugin(fake, cacheDir, "test", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithStatusCacheTTL(-time.Second)})
+		Expect(err).To(HaveOccurred())
+
+		ocicni, err := newCNIPlugin(fake, cacheDir, "test", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithStatusCacheTTL(time.Hour)})
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		// Concurrent callers share one invocation
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Go(func() {
+				defer GinkgoRecover()
+
+				Expect(ocicni.Status()).To(Succeed())
+			})
+		}
+
+		Eventually(invocations.Load).Should(BeEquivalentTo(1))
+		close(release)
+		wg.Wait()
+
+		plugin, ok := ocicni.(*cniNetworkPlugin)
+		Expect(ok).To(BeTrue())
+
+		// Later callers get the cached result
+		broken := errors.New("status fails")
+		statusErr.Store(&broken)
+		Expect(ocicni.Status()).To(Succeed())
+		Expect(invocations.Load()).To(BeEquivalentTo(1))
+
+		// Syncing an unchanged default network keeps the cache
+		Expect(plugin.syncNetworkConfig(context.Background())).To(Succeed())
+		Expect(ocicni.Status()).To(Succeed())
+		Expect(invocations.Load()).To(BeEquivalentTo(1))
+
+		// Changing the default network invalidates it, and errors are
+		// cached as well
+		Expect(os.WriteFile(confPath, []byte(`{"name": "test", "type": "myplugin", "cniVersion": "1.1.0", "mtu": 1400}`), 0o644)).To(Succeed())
+		Expect(plugin.syncNetworkConfig(context.Background())).To(Succeed())
+		Expect(ocicni.Status()).To(MatchError(ContainSubstring("status fails")))
+		Expect(ocicni.Status()).To(MatchError(ContainSubstring("status fails")))
+		Expect(invocations.Load()).To(BeEquivalentTo(2))
+	})
+
+	It("does not fail waiting status callers when the first caller is canceled", func() {
+		_, _, err := writeConfig(tmpDir, "10-test.conf", "test", "myplugin", "1.1.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		var invocations atomic.Int32
+
+		release := make(chan struct{})
+		fake := &fakeExec{statusFns: map[string]func(ctx context.Context) error{
+			"myplugin": func(ctx context.Context) error {
+				invocations.Add(1)
+
+				select {
+				case <-release:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			},
+		}}
+
+		ocicni, err := newCNIPlugin(fake, cacheDir, "test", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithStatusCacheTTL(time.Hour)})
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		leaderCtx, cancel := context.WithCancel(context.Background())
+		leaderDone := make(chan error, 1)
+
+		go func() {
+			leaderDone <- ocicni.StatusWithContext(leaderCtx)
+		}()
+
+		Eventually(invocations.Load).Should(BeEquivalentTo(1))
+
+		waiterDone := make(chan error, 1)
+
+		go func() {
+			waiterDone <- ocicni.StatusWithContext(context.Background())
+		}()
+
+		// The canceled caller returns, the shared invocation goes on
+		cancel()
+		Eventually(leaderDone).Should(Receive(MatchError(context.Canceled)))
+		Consistently(waiterDone, 200*time.Millisecond).ShouldNot(Receive())
+
+		close(release)
+		Eventually(waiterDone).Should(Receive(BeNil()))
+
+		Expect(ocicni.Status()).To(Succeed())
+		Expect(invocations.Load()).To(BeEquivalentTo(1))
+	})
+
 	It("finds an ASCIIbetically first network configuration as default real-time if given no default network name", func() {
 		ocicni, err := initCNI(&fakeExec{}, "", "", tmpDir, true, "/opt/cni/bin")
 		Expect(err).NotTo(HaveOccurred())
@@ -540,7 +747,7 @@ var _ = Describe("ocicni operations", func() {
 	})
 
 	It("build different runtime configs", func() {
-		ifName := "eth0"
+		attachment := &NetAttachment{Ifname: "eth0"}
 		podNetwork := &PodNetwork{}
 
 		var (
@@ -550,44 +757,110 @@ var _ = Describe("ocicni operations", func() {
 		)
 
 		// empty runtimeConfig
-		_, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		// runtimeConfig with invalid IP
 		runtimeConfig = &RuntimeConfig{IP: "172.16"}
-		_, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).To(HaveOccurred())
 
 		// runtimeConfig with valid IP
 		runtimeConfig = &RuntimeConfig{IP: "172.16.0.1"}
-		rt, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(rt.Args).To(HaveLen(6))
 		Expect(rt.Args[5][1]).To(Equal("172.16.0.1"))
 
+		// runtimeConfig with dual-stack IPs, passed as CNI_ARGS without
+		// the ips capability
+		runtimeConfig = &RuntimeConfig{IPs: []string{"172.16.0.1/24", "fd00::1"}}
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.Args).To(ContainElement([2]string{"IP", "172.16.0.1,fd00::1"}))
+		Expect(rt.CapabilityArgs).NotTo(HaveKey("ips"))
+
+		// and with the ips capability
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, map[string]bool{"ips": true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.Args).To(HaveLen(5))
+		Expect(rt.CapabilityArgs).To(HaveKeyWithValue("ips", []string{"172.16.0.1/24", "fd00::1"}))
+
+		// runtimeConfig with more than one IP per family
+		runtimeConfig = &RuntimeConfig{IPs: []string{"172.16.0.1", "172.16.0.2"}}
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+		Expect(err).To(MatchError(ContainSubstring("more than one static IPv4 address")))
+
+		// runtimeConfig with invalid IPs
+		runtimeConfig = &RuntimeConfig{IPs: []string{"172.16/24"}}
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+		Expect(err).To(HaveOccurred())
+
+		// runtimeConfig with both IP and IPs
+		runtimeConfig = &RuntimeConfig{IP: "172.16.0.1", IPs: []string{"fd00::1"}}
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+		Expect(err).To(HaveOccurred())
+
+		// runtimeConfig with DNS
+		runtimeConfig = &RuntimeConfig{DNS: &DNSConfig{Servers: []string{"10.0.0.53"}, Searches: []string{"cluster.local"}}}
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.CapabilityArgs).To(HaveKeyWithValue("dns", map[string][]string{
+			"servers":  {"10.0.0.53"},
+			"searches": {"cluster.local"},
+		}))
+
 		// runtimeConfig with invalid MAC
 		runtimeConfig = &RuntimeConfig{MAC: "f0:a6"}
-		_, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).To(HaveOccurred())
 
 		// runtimeConfig with valid MAC
 		runtimeConfig = &RuntimeConfig{MAC: "9e:0c:d9:b2:f0:a6"}
-		rt, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(rt.Args).To(HaveLen(6))
 		Expect(rt.Args[5][1]).To(Equal("9e:0c:d9:b2:f0:a6"))
 
 		// runtimeConfig with valid IP and valid MAC
 		runtimeConfig = &RuntimeConfig{IP: "172.16.0.1", MAC: "9e:0c:d9:b2:f0:a6"}
-		rt, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(rt.Args).To(HaveLen(7))
 		Expect(rt.Args[5][1]).To(Equal("172.16.0.1"))
 		Expect(rt.Args[6][1]).To(Equal("9e:0c:d9:b2:f0:a6"))
 
+		// runtimeConfig with MAC and the mac capability
+		runtimeConfig = &RuntimeConfig{MAC: "9e:0c:d9:b2:f0:a6"}
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, map[string]bool{"mac": true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.Args).To(HaveLen(5))
+		Expect(rt.CapabilityArgs).To(HaveKeyWithValue("mac", "9e:0c:d9:b2:f0:a6"))
+
+		// runtimeConfig with device ID and InfiniBand GUID
+		runtimeConfig = &RuntimeConfig{DeviceID: "0000:03:00.1", InfinibandGUID: "c2:11:22:33:44:55:66:77"}
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.CapabilityArgs).To(HaveKeyWithValue("deviceID", "0000:03:00.1"))
+		Expect(rt.CapabilityArgs).To(HaveKeyWithValue("infinibandGUID", "c2:11:22:33:44:55:66:77"))
+
+		// runtimeConfig with invalid device ID
+		for _, deviceID := range []string{"03:00.1", "0000:03:20.1", "0000:03:00.8"} {
+			runtimeConfig = &RuntimeConfig{DeviceID: deviceID}
+			_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+			Expect(err).To(MatchError(ContainSubstring("not a PCI address")))
+		}
+
+		// runtimeConfig with invalid InfiniBand GUID
+		for _, guid := range []string{"9e:0c:d9:b2:f0:a6", "c2:11:22:33:44:55:66"} {
+			runtimeConfig = &RuntimeConfig{InfinibandGUID: guid}
+			_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+			Expect(err).To(MatchError(ContainSubstring("invalid InfiniBand GUID")))
+		}
+
 		// runtimeConfig with portMappings is nil
 		runtimeConfig = &RuntimeConfig{PortMappings: nil}
-		_, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		// runtimeConfig with valid portMappings
@@ -597,7 +870,7 @@ var _ = Describe("ocicni operations", func() {
 			Protocol:      "tcp",
 			HostIP:        "192.168.0.1",
 		}}}
-		rt, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		pm, ok := rt.CapabilityArgs["portMappings"].([]PortMapping)
@@ -608,9 +881,42 @@ var _ = Describe("ocicni operations", func() {
 		Expect(pm[0].Protocol).To(Equal("tcp"))
 		Expect(pm[0].HostIP).To(Equal("192.168.0.1"))
 
+		// runtimeConfig with portMappings which are normalized
+		runtimeConfig = &RuntimeConfig{PortMappings: []PortMapping{
+			{HostPort: 8080, ContainerPort: 80, Protocol: "TCP"},
+			{HostPort: 5353, ContainerPort: 53},
+		}}
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.CapabilityArgs).To(HaveKeyWithValue("portMappings", []PortMapping{
+			{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+			{HostPort: 5353, ContainerPort: 53, Protocol: "tcp"},
+		}))
+
+		// runtimeConfig with invalid portMappings
+		for pm, message := range map[PortMapping]string{
+			{HostPort: 0, ContainerPort: 80, Protocol: "tcp"}:                     ":0->80/tcp: host port out of range",
+			{HostPort: 8080, ContainerPort: 70000, Protocol: "tcp"}:               ":8080->70000/tcp: container port out of range",
+			{HostPort: 8080, ContainerPort: -1, Protocol: "udp"}:                  ":8080->-1/udp: container port out of range",
+			{HostPort: 8080, ContainerPort: 80, Protocol: "icmp"}:                 `unknown protocol "icmp"`,
+			{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "1.2.3"}: "1.2.3:8080->80/tcp: unable to parse host IP",
+		} {
+			runtimeConfig = &RuntimeConfig{PortMappings: []PortMapping{pm}}
+			_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+		}
+
+		// runtimeConfig with portMappings whose host IP family is not used by the pod
+		runtimeConfig = &RuntimeConfig{
+			IPs:          []string{"172.16.0.1"},
+			PortMappings: []PortMapping{{HostPort: 8080, ContainerPort: 80, HostIP: "fd00::1"}},
+		}
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+		Expect(err).To(MatchError(ContainSubstring("host IP family does not match")))
+
 		// runtimeConfig with bandwidth is nil
 		runtimeConfig = &RuntimeConfig{Bandwidth: nil}
-		_, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		// runtimeConfig with valid bandwidth
@@ -620,7 +926,7 @@ var _ = Describe("ocicni operations", func() {
 			EgressRate:   3,
 			EgressBurst:  4,
 		}}
-		rt, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		bw, ok := rt.CapabilityArgs["bandwidth"].(map[string]uint64)
@@ -632,7 +938,7 @@ var _ = Describe("ocicni operations", func() {
 
 		// runtimeConfig with ipRanges is empty
 		runtimeConfig = &RuntimeConfig{IpRanges: [][]IpRange{}}
-		_, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		// runtimeConfig with valid ipRanges
@@ -642,7 +948,7 @@ var _ = Describe("ocicni operations", func() {
 			RangeEnd:   "192.168.0.200",
 			Gateway:    "192.168.0.254",
 		}}}}
-		rt, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		ir, ok := rt.CapabilityArgs["ipRanges"].([][]IpRange)
@@ -652,12 +958,375 @@ var _ = Describe("ocicni operations", func() {
 		Expect(ir[0][0].Gateway).To(Equal("192.168.0.254"))
 
 		runtimeConfig = &RuntimeConfig{CgroupPath: "/slice/pod/testing"}
-		rt, err = buildCNIRuntimeConf(podNetwork, ifName, runtimeConfig)
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		cg, ok := rt.CapabilityArgs["cgroupPath"].(string)
 		Expect(ok).To(BeTrue())
 		Expect(cg).To(Equal("/slice/pod/testing"))
+
+		// runtimeConfig with additional capability args
+		runtimeConfig = &RuntimeConfig{CapabilityArgs: map[string]any{"io.example/tenant": "blue"}}
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.CapabilityArgs).To(HaveKeyWithValue("io.example/tenant", "blue"))
+
+		// runtimeConfig with additional capability args overlapping ocicni's
+		runtimeConfig = &RuntimeConfig{CgroupPath: "/slice/pod/testing", CapabilityArgs: map[string]any{"cgroupPath": "/other"}}
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, runtimeConfig, nil)
+		Expect(err).To(MatchError(ContainSubstring(`capability "cgroupPath" is set by ocicni`)))
+	})
+
+	It("parses bandwidth limits from Kubernetes quantities", func() {
+		for quantity, expected := range map[string]uint64{
+			"10M":     10000000,
+			"1Gi":     1073741824,
+			"1.5k":    1500,
+			"0.1k":    100,
+			"100":     100,
+			"1e6":     1000000,
+			"1500m":   2,
+			"32G":     32000000000,
+			".5M":     500000,
+			"1234567": 1234567,
+		} {
+			rate, err := ParseBandwidth(quantity)
+			Expect(err).NotTo(HaveOccurred(), quantity)
+			Expect(rate).To(Equal(expected), quantity)
+		}
+
+		for quantity, message := range map[string]string{
+			"":       "invalid bandwidth quantity",
+			"10 M":   "invalid bandwidth quantity",
+			"-10M":   "invalid bandwidth quantity",
+			"10Mb":   "invalid bandwidth quantity",
+			"1e99":   "exponent 99 out of range",
+			"0":      "must be greater than zero",
+			"0.0k":   "must be greater than zero",
+			"33G":    "above the maximum of 32Gbps",
+			"32.1Gi": "above the maximum of 32Gbps",
+		} {
+			_, err := ParseBandwidth(quantity)
+			Expect(err).To(MatchError(ContainSubstring(message)), quantity)
+		}
+
+		bandwidth, err := BandwidthConfigFromAnnotations(map[string]string{
+			IngressBandwidthAnnotation: "10M",
+			EgressBandwidthAnnotation:  "1M",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bandwidth).To(Equal(&BandwidthConfig{
+			IngressRate:  10000000,
+			IngressBurst: math.MaxUint32,
+			EgressRate:   1000000,
+			EgressBurst:  math.MaxUint32,
+		}))
+
+		bandwidth, err = NewBandwidthConfig("", "1M")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bandwidth.IngressRate).To(BeZero())
+		Expect(bandwidth.EgressRate).To(Equal(uint64(1000000)))
+
+		bandwidth, err = BandwidthConfigFromAnnotations(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bandwidth).To(BeNil())
+
+		_, err = NewBandwidthConfig("fast", "")
+		Expect(err).To(MatchError(`invalid ingress bandwidth: invalid bandwidth quantity "fast"`))
+	})
+
+	It("rejects duplicate and conflicting port mappings of a pod", func() {
+		podNetwork := &PodNetwork{
+			Networks: []NetAttachment{{Name: "net1"}, {Name: "net2"}},
+			RuntimeConfig: map[string]RuntimeConfig{
+				"net1": {PortMappings: []PortMapping{
+					{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "192.168.0.1"},
+					{HostPort: 8080, ContainerPort: 80, Protocol: "udp"},
+				}},
+				"net2": {PortMappings: []PortMapping{
+					{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "192.168.0.2"},
+					{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "fd00::1"},
+				}},
+			},
+		}
+		Expect(validateRuntimeConfigs(podNetwork)).To(Succeed())
+
+		// Same tuple on another network
+		podNetwork.RuntimeConfig["net2"] = RuntimeConfig{PortMappings: []PortMapping{
+			{HostPort: 8080, ContainerPort: 80, Protocol: "UDP"},
+		}}
+		Expect(validateRuntimeConfigs(podNetwork)).To(MatchError("duplicate port mapping :8080->80/udp"))
+
+		// Wildcard host IP overlapping a specific one
+		podNetwork.RuntimeConfig["net2"] = RuntimeConfig{PortMappings: []PortMapping{
+			{HostPort: 8080, ContainerPort: 81, Protocol: "tcp", HostIP: "0.0.0.0"},
+		}}
+		Expect(validateRuntimeConfigs(podNetwork)).To(MatchError(
+			"port mapping 0.0.0.0:8080->81/tcp conflicts with port mapping 192.168.0.1:8080->80/tcp"))
+	})
+
+	It("validates static IPs against IP ranges and network subnets", func() {
+		confList, err := libcni.ConfListFromBytes([]byte(`{
+	"cniVersion": "1.0.0",
+	"name": "net1",
+	"plugins": [{
+		"type": "bridge",
+		"ipam": {
+			"type": "host-local",
+			"ranges": [[{"subnet": "10.88.0.0/16", "rangeStart": "10.88.1.0", "rangeEnd": "10.88.1.255"}]]
+		}
+	}]
+}`))
+		Expect(err).NotTo(HaveOccurred())
+
+		networks := map[string]*cniNetwork{"net1": {name: "net1", config: confList}}
+		podNetwork := &PodNetwork{
+			Networks:      []NetAttachment{{Name: "net1"}},
+			RuntimeConfig: map[string]RuntimeConfig{"net1": {IP: "10.88.1.5"}},
+		}
+		Expect(validatePodStaticIPs(podNetwork, networks)).To(Succeed())
+
+		// Outside of the range of the network subnet
+		podNetwork.RuntimeConfig["net1"] = RuntimeConfig{IP: "10.88.2.5"}
+		Expect(validatePodStaticIPs(podNetwork, networks)).To(MatchError(
+			`network "net1": static IP 10.88.2.5 is outside of the IPAM ranges of the network`))
+
+		// IPv6 address for an IPv4-only network
+		podNetwork.RuntimeConfig["net1"] = RuntimeConfig{IPs: []string{"fd00::5/64"}}
+		Expect(validatePodStaticIPs(podNetwork, networks)).To(MatchError(
+			`network "net1": static IP fd00::5 is IPv6, but the IPAM ranges of the network contain no IPv6 range`))
+
+		// Requested IP ranges take precedence over the network subnets
+		podNetwork.RuntimeConfig["net1"] = RuntimeConfig{
+			IP:       "10.89.0.5",
+			IpRanges: [][]IpRange{{{Subnet: "10.89.0.0/24"}}},
+		}
+		Expect(validatePodStaticIPs(podNetwork, networks)).To(Succeed())
+
+		podNetwork.RuntimeConfig["net1"] = RuntimeConfig{
+			IP:       "10.88.1.5",
+			IpRanges: [][]IpRange{{{Subnet: "10.89.0.0/24"}}},
+		}
+		Expect(validatePodStaticIPs(podNetwork, networks)).To(MatchError(
+			`network "net1": static IP 10.88.1.5 is outside of the requested IP ranges`))
+
+		// Networks without IPAM ranges are not checked
+		confList, err = libcni.ConfListFromBytes([]byte(`{
+	"cniVersion": "1.0.0",
+	"name": "net1",
+	"plugins": [{"type": "bridge", "ipam": {"type": "dhcp"}}]
+}`))
+		Expect(err).NotTo(HaveOccurred())
+		networks["net1"].config = confList
+		podNetwork.RuntimeConfig["net1"] = RuntimeConfig{IP: "10.88.2.5"}
+		Expect(validatePodStaticIPs(podNetwork, networks)).To(Succeed())
+	})
+
+	It("uses per-attachment runtime configs and args", func() {
+		podNetwork := &PodNetwork{
+			Networks: []NetAttachment{
+				{Name: "sriov", Ifname: "net1"},
+				{Name: "sriov", Ifname: "net2"},
+			},
+			RuntimeConfig: map[string]RuntimeConfig{
+				"sriov": {MAC: "9e:0c:d9:b2:f0:a7"},
+			},
+			AttachmentConfig: map[NetAttachmentKey]NetAttachmentConfig{
+				{Name: "sriov", Ifname: "net1"}: {RuntimeConfig: &RuntimeConfig{MAC: "9e:0c:d9:b2:f0:a6"}},
+				{Name: "sriov", Ifname: "net2"}: {Args: [][2]string{{"VF", "2"}}},
+			},
+		}
+		Expect(validateRuntimeConfigs(podNetwork)).To(Succeed())
+
+		attachment := &podNetwork.Networks[0]
+		rt, err := buildCNIRuntimeConf(podNetwork, attachment, podNetwork.runtimeConfigFor(attachment), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.IfName).To(Equal("net1"))
+		Expect(rt.Args).To(ContainElement([2]string{"MAC", "9e:0c:d9:b2:f0:a6"}))
+
+		// The second attachment falls back to the network-keyed config
+		attachment = &podNetwork.Networks[1]
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, podNetwork.runtimeConfigFor(attachment), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.IfName).To(Equal("net2"))
+		Expect(rt.Args).To(ContainElement([2]string{"MAC", "9e:0c:d9:b2:f0:a7"}))
+		Expect(rt.Args).To(ContainElement([2]string{"VF", "2"}))
+
+		// Pod args are passed to all attachments
+		podNetwork.Args = [][2]string{{"TENANT", "blue"}}
+		rt, err = buildCNIRuntimeConf(podNetwork, attachment, podNetwork.runtimeConfigFor(attachment), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rt.Args).To(ContainElements([2]string{"TENANT", "blue"}, [2]string{"VF", "2"}))
+
+		// Invalid, reserved and duplicate args are refused
+		for args, message := range map[[2]string]string{
+			{"TEN;ANT", "blue"}:       `invalid CNI_ARGS key "TEN;ANT"`,
+			{"TENANT", "a=b"}:         `invalid value "a=b" of CNI_ARGS key "TENANT"`,
+			{"K8S_POD_NAME", "other"}: `CNI_ARGS key "K8S_POD_NAME" is set by ocicni`,
+			{"VF", "3"}:               `duplicate CNI_ARGS key "VF"`,
+		} {
+			podNetwork.Args = [][2]string{args}
+			_, err = buildCNIRuntimeConf(podNetwork, attachment, podNetwork.runtimeConfigFor(attachment), nil)
+			Expect(err).To(MatchError(message))
+		}
+
+		podNetwork.Args = nil
+
+		// Attachment args are validated like pod args
+		podNetwork.AttachmentConfig[NetAttachmentKey{Name: "sriov", Ifname: "net2"}] = NetAttachmentConfig{
+			Args: [][2]string{{"VF", "2"}, {"MAC", "9e:0c:d9:b2:f0:a8"}},
+		}
+		_, err = buildCNIRuntimeConf(podNetwork, attachment, podNetwork.runtimeConfigFor(attachment), nil)
+		Expect(err).To(MatchError(`CNI_ARGS key "MAC" is set by ocicni`))
+
+		// Attachment configs of attachments the pod does not have are refused
+		podNetwork.AttachmentConfig[NetAttachmentKey{Name: "sriov", Ifname: "net3"}] = NetAttachmentConfig{}
+		Expect(validateRuntimeConfigs(podNetwork)).To(MatchError(ContainSubstring(`interface "net3" of network "sriov" which is not attached`)))
+		delete(podNetwork.AttachmentConfig, NetAttachmentKey{Name: "sriov", Ifname: "net3"})
+
+		// Runtime configs of networks the pod is not attached to are refused
+		podNetwork.RuntimeConfig["other"] = RuntimeConfig{}
+		Expect(validateRuntimeConfigs(podNetwork)).To(MatchError(ContainSubstring(`network "other" which is not attached`)))
+	})
+
+	It("propagates CNI_ARGS of the environment only if enabled", func() {
+		Expect(os.Setenv("CNI_ARGS", "FOO=bar;BAZ=qux")).To(Succeed())
+
+		defer func() {
+			Expect(os.Unsetenv("CNI_ARGS")).To(Succeed())
+		}()
+
+		for _, enabled := range []bool{false, true} {
+			conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeExec{}
+			fake.addPlugin(nil, conf, &cniv04.Result{CNIVersion: "0.4.0"})
+
+			opts := []Option{}
+			if enabled {
+				opts = append(opts, WithCNIArgsFromEnv())
+			}
+
+			ocicni, err := newCNIPlugin(fake, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, opts)
+			Expect(err).NotTo(HaveOccurred())
+
+			podNet := PodNetwork{
+				Name:      "pod1",
+				Namespace: "namespace1",
+				ID:        "1234567890",
+				NetNS:     networkNS.Path(),
+			}
+			dryRunner, ok := ocicni.(DryRunner)
+			Expect(ok).To(BeTrue())
+
+			results, err := dryRunner.SetUpPodDryRun(context.Background(), podNet)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(1))
+
+			if enabled {
+				Expect(results[0].RuntimeConf.Args).To(ContainElements([2]string{"FOO", "bar"}, [2]string{"BAZ", "qux"}))
+			} else {
+				Expect(results[0].RuntimeConf.Args).NotTo(ContainElement([2]string{"FOO", "bar"}))
+			}
+
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}
+	})
+
+	It("synthesizes interface names according to the naming policy", func() {
+		_, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		conf := `{"name": "network3", "cniVersion": "0.4.0", "ifnamePrefix": "sec", "plugins": [{"type": "myplugin"}]}`
+		err = os.WriteFile(filepath.Join(tmpDir, "20-network3.conflist"), []byte(conf), 0o644)
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = writeConfig(tmpDir, "30-network4.conf", "network4", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		newPlugin := func(opts ...Option) *cniNetworkPlugin {
+			ocicni, err := newCNIPlugin(&fakeExec{}, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, opts)
+			Expect(err).NotTo(HaveOccurred())
+
+			plugin, ok := ocicni.(*cniNetworkPlugin)
+			Expect(ok).To(BeTrue())
+
+			return plugin
+		}
+
+		ifnames := func(plugin *cniNetworkPlugin, networks ...NetAttachment) ([]string, error) {
+			podNet := &PodNetwork{Networks: networks}
+			if err := plugin.fillPodNetworks(podNet); err != nil {
+				return nil, err
+			}
+
+			names := []string{}
+			for _, net := range podNet.Networks {
+				names = append(names, net.Ifname)
+			}
+
+			return names, nil
+		}
+
+		// Default naming, with a conflist prefix for network3
+		plugin := newPlugin()
+		Expect(ifnames(plugin, NetAttachment{Name: "network2"}, NetAttachment{Name: "network3"}, NetAttachment{Name: "network4"})).
+			To(Equal([]string{"eth0", "sec0", "eth1"}))
+
+		// Global and per-network prefixes
+		plugin = newPlugin(WithInterfacePrefix("if"), WithNetworkInterfacePrefix("network3", "mine"))
+		Expect(ifnames(plugin, NetAttachment{Name: "network2"}, NetAttachment{Name: "network3"}, NetAttachment{Name: "network4"})).
+			To(Equal([]string{"if0", "mine0", "if1"}))
+
+		// Multus conventions
+		plugin = newPlugin(WithInterfaceNamer(MultusInterfaceNamer))
+		Expect(ifnames(plugin, NetAttachment{Name: "network2"}, NetAttachment{Name: "network4", Ifname: "net1"}, NetAttachment{Name: "network4"})).
+			To(Equal([]string{"eth0", "net1", "net2"}))
+
+		// Explicit names are validated
+		_, err = ifnames(plugin, NetAttachment{Name: "network2", Ifname: "averyveryverylongname"})
+		Expect(err).To(MatchError(ContainSubstring("interface name is too long")))
+		_, err = ifnames(plugin, NetAttachment{Name: "network2", Ifname: "eth:0"})
+		Expect(err).To(HaveOccurred())
+
+		_, err = newCNIPlugin(&fakeExec{}, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithInterfacePrefix("a/b")})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("passes the network namespace to cached CHECK and DEL", func() {
+		conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin([]string{
+			"CNI_CONTAINERID=1234567890",
+			"CNI_NETNS=" + networkNS.Path(),
+			"CNI_IFNAME=eth0",
+		}, conf, &cniv04.Result{CNIVersion: "0.4.0"})
+
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+		}
+
+		_, err = ocicni.SetUpPod(podNet)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = ocicni.GetPodNetworkStatus(podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.chkIndex).To(Equal(1))
+
+		Expect(ocicni.TearDownPod(podNet)).To(Succeed())
+		Expect(fake.delIndex).To(Equal(1))
 	})
 
 	It("sets up and tears down a pod using the default network", func() {
@@ -770,84 +1439,1071 @@ var _ = Describe("ocicni operations", func() {
 		Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
 	})
 
-	It("handles concurrent pod operations safely", func() {
-		conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+	It("returns the plugin invocations of a dry run without executing plugins", func() {
+		conf := `{
+	"name": "network2",
+	"type": "myplugin",
+	"cniVersion": "0.4.0",
+	"capabilities": {"portMappings": true}
+}`
+		err := os.WriteFile(filepath.Join(tmpDir, "10-network2.conf"), []byte(conf), 0o644)
 		Expect(err).NotTo(HaveOccurred())
 
-		const goroutines = 10
-
 		fake := &fakeExec{}
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, true, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
 
-		addResult := &cniv04.Result{
-			CNIVersion: "0.4.0",
-			Interfaces: []*cniv04.Interface{
-				{
-					Name:    "eth0",
-					Mac:     "01:23:45:67:89:01",
-					Sandbox: networkNS.Path(),
-				},
-			},
-			IPs: []*cniv04.IPConfig{
-				{
-					Interface: cniv04.Int(0),
-					Version:   "4",
-					Address:   *ensureCIDR("1.1.1.2/24"),
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			UID:       "9414bd03-b3d3-453e-9d9f-47dcee07958c",
+			NetNS:     networkNS.Path(),
+			RuntimeConfig: map[string]RuntimeConfig{
+				"network2": {
+					PortMappings: []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
 				},
 			},
 		}
+		dryRunner, ok := ocicni.(DryRunner)
+		Expect(ok).To(BeTrue())
+
+		results, err := dryRunner.SetUpPodDryRun(context.Background(), podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.addIndex).To(BeZero())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Name).To(Equal("network2"))
+		Expect(results[0].Ifname).To(Equal("eth0"))
+		Expect(results[0].RuntimeConf.IfName).To(Equal("eth0"))
+		Expect(results[0].Invocations).To(HaveLen(1))
+
+		invocation := results[0].Invocations[0]
+		Expect(invocation.Env).To(ContainElements("CNI_COMMAND=ADD", "CNI_IFNAME=eth0", "CNI_NETNS="+networkNS.Path()))
+		for _, kv := range invocation.Env {
+			Expect(kv).To(HavePrefix("CNI_"))
+		}
+
+		stdin := map[string]any{}
+		Expect(json.Unmarshal(invocation.Stdin, &stdin)).To(Succeed())
+		Expect(stdin).To(HaveKeyWithValue("name", "network2"))
+		Expect(stdin).To(HaveKey("runtimeConfig"))
+		Expect(stdin["runtimeConfig"]).To(HaveKey("portMappings"))
+
+		// Nothing is cached by a dry run
+		entries, err := os.ReadDir(filepath.Join(cacheDir, "results"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+
+		Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+	})
+
+	It("handles concurrent pod operations safely", func() {
+		conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		const goroutines = 10
+
+		fake := &fakeExec{}
+
+		addResult := &cniv04.Result{
+			CNIVersion: "0.4.0",
+			Interfaces: []*cniv04.Interface{
+				{
+					Name:    "eth0",
+					Mac:     "01:23:45:67:89:01",
+					Sandbox: networkNS.Path(),
+				},
+			},
+			IPs: []*cniv04.IPConfig{
+				{
+					Interface: cniv04.Int(0),
+					Version:   "4",
+					Address:   *ensureCIDR("1.1.1.2/24"),
+				},
+			},
+		}
+
+		for range goroutines {
+			fake.addPlugin(nil, conf, addResult)
+		}
+
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, true, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		Eventually(func() bool {
+			return ocicni.Status() == nil
+		}, 5*time.Second, 100*time.Millisecond).Should(BeTrue())
+
+		var wg sync.WaitGroup
+
+		wg.Add(goroutines)
+
+		errCh := make(chan error, goroutines*2)
+
+		for i := range goroutines {
+			go func() {
+				defer wg.Done()
+
+				podNet := PodNetwork{
+					Name:      fmt.Sprintf("pod%d", i),
+					Namespace: "namespace1",
+					ID:        fmt.Sprintf("pod-id-%d", i),
+					NetNS:     networkNS.Path(),
+				}
+
+				_, setupErr := ocicni.SetUpPod(podNet)
+				if setupErr != nil {
+					errCh <- setupErr
+
+					return
+				}
+
+				teardownErr := ocicni.TearDownPod(podNet)
+				if teardownErr != nil {
+					errCh <- teardownErr
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(errCh)
+
+		for err := range errCh {
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	It("serializes pod operations across processes with file locking", func() {
+		conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin(nil, conf, &cniv04.Result{CNIVersion: "0.4.0"})
+
+		ocicni, err := newCNIPlugin(fake, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithFileLocking()})
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+		}
+
+		// Another process holds the container lock
+		otherLocker, err := newFileLocker(cacheDir)
+		Expect(err).NotTo(HaveOccurred())
+		containerLock, err := otherLocker.lockContainer(podNet.ID)
+		Expect(err).NotTo(HaveOccurred())
+
+		done := make(chan error, 1)
+
+		go func() {
+			_, err := ocicni.SetUpPod(podNet)
+			done <- err
+		}()
+
+		Consistently(done, time.Second).ShouldNot(Receive())
+		containerLock.unlock()
+		Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+		Expect(fake.addIndex).To(Equal(1))
+		Expect(filepath.Join(cacheDir, lockDirName, podNet.ID+lockFileSuffix)).To(BeAnExistingFile())
+
+		// Status waits for GC in another process, which may remove lock files
+		gcLock, err := otherLocker.lockGC(true)
+		Expect(err).NotTo(HaveOccurred())
+
+		go func() {
+			_, err := ocicni.GetPodNetworkStatus(podNet)
+			done <- err
+		}()
+
+		Consistently(done, time.Second).ShouldNot(Receive())
+		gcLock.unlock()
+		Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+
+		// GC removes lock files of containers which are no longer valid
+		Expect(ocicni.GC(context.Background(), nil)).To(Succeed())
+		Expect(filepath.Join(cacheDir, lockDirName, podNet.ID+lockFileSuffix)).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(cacheDir, lockDirName, gcLockFileName)).To(BeAnExistingFile())
+	})
+
+	It("calls pre- and post-hooks around network operations", func() {
+		conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin([]string{"CNI_IFNAME=hooked0"}, conf, &cniv04.Result{CNIVersion: "0.4.0"})
+		fake.addPlugin(nil, conf, &cniv04.Result{CNIVersion: "0.4.0"})
+
+		var (
+			events  []string
+			vetoDel bool
+			failAdd bool
+		)
+
+		preHook := func(_ context.Context, event *HookEvent) error {
+			events = append(events, "pre-"+string(event.Operation))
+
+			switch {
+			case event.Operation == OperationAdd:
+				// Pre-hooks may modify the runtime config
+				event.RuntimeConf.IfName = "hooked0"
+			case event.Operation == OperationDel && vetoDel:
+				return errors.New("vetoed")
+			}
+
+			return nil
+		}
+		postHook := func(_ context.Context, event *HookEvent) error {
+			events = append(events, "post-"+string(event.Operation))
+			Expect(event.PodNetwork.Name).To(Equal("pod1"))
+			Expect(event.Attachment.Name).To(Equal("network2"))
+
+			if event.Operation == OperationAdd {
+				Expect(event.Result).NotTo(BeNil())
+
+				if failAdd {
+					return errors.New("post-add failure")
+				}
+			}
+
+			if event.Operation == OperationDel {
+				return errors.New("ignored")
+			}
+
+			return nil
+		}
+
+		ocicni, err := newCNIPlugin(fake, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithPreHook(preHook), WithPostHook(postHook)})
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+		}
+
+		results, err := ocicni.SetUpPod(podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Ifname).To(Equal("hooked0"))
+		Expect(events).To(Equal([]string{"pre-ADD", "post-ADD"}))
+
+		// A vetoed DEL does not execute the plugin
+		vetoDel = true
+		err = ocicni.TearDownPod(podNet)
+		Expect(err).To(MatchError(ContainSubstring("pre-DEL hook failed: vetoed")))
+		Expect(fake.delIndex).To(BeZero())
+
+		// Post-hook failures of DEL are ignored
+		vetoDel = false
+		events = nil
+		podNet.Networks = []NetAttachment{{Name: "network2", Ifname: "hooked0"}}
+		Expect(ocicni.TearDownPod(podNet)).To(Succeed())
+		Expect(fake.delIndex).To(Equal(1))
+		Expect(events).To(Equal([]string{"pre-DEL", "post-DEL"}))
+
+		// Post-hook failures of ADD fail the operation
+		failAdd = true
+		podNet.Networks = nil
+		_, err = ocicni.SetUpPod(podNet)
+		Expect(err).To(MatchError(ContainSubstring("post-ADD hook failed: post-add failure")))
+		Expect(fake.addIndex).To(Equal(2))
+	})
+
+	It("sets sysctls in the pod network namespace", func() {
+		_, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		// Loopback is set up by a plugin, so that all plugin invocations
+		// can be checked to follow the sysctls
+		fake := &fakeExec{}
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+
+		ocicni, err := newCNIPlugin(fake, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithLoopbackPolicy(LoopbackPlugin)})
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		err = networkNS.Do(func(_ ns.NetNS) error {
+			return netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0.100"}, PeerName: "peer0"})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+			Sysctls: map[string]string{
+				"net.ipv4.ip_unprivileged_port_start": "80",
+				"kernel.shm_rmid_forced":              "1",
+			},
+		}
+
+		_, err = ocicni.SetUpPod(podNet)
+		Expect(err).To(MatchError(ContainSubstring(`sysctl "kernel.shm_rmid_forced" is not allowed`)))
+		Expect(fake.addIndex).To(BeZero())
+
+		// Dots in interface names are written as slashes, but must not
+		// escape the interface directory
+		delete(podNet.Sysctls, "kernel.shm_rmid_forced")
+
+		for _, key := range []string{"net.ipv4.conf.//.forwarding", "net.ipv4.conf./.forwarding", "net.ipv4.conf.eth0.rp/filter"} {
+			podNet.Sysctls[key] = "1"
+			_, err = ocicni.SetUpPod(podNet)
+			Expect(err).To(MatchError(ContainSubstring(fmt.Sprintf("invalid sysctl %q", key))))
+			delete(podNet.Sysctls, key)
+		}
+
+		Expect(sysctlPath("net.ipv4.conf.eth0/100.rp_filter")).To(Equal("net/ipv4/conf/eth0.100/rp_filter"))
+
+		// Failures report the offending sysctl, before any plugin runs
+		podNet.Sysctls["net.ipv4.conf.missing0.forwarding"] = "1"
+		_, err = ocicni.SetUpPod(podNet)
+		Expect(err).To(MatchError(ContainSubstring(`failed to set sysctl "net.ipv4.conf.missing0.forwarding"`)))
+		Expect(fake.addIndex).To(BeZero())
+
+		delete(podNet.Sysctls, "net.ipv4.conf.missing0.forwarding")
+		podNet.Sysctls["net.ipv4.conf.eth0/100.rp_filter"] = "2"
+		_, err = ocicni.SetUpPod(podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.addIndex).To(Equal(2))
+
+		err = networkNS.Do(func(_ ns.NetNS) error {
+			defer GinkgoRecover()
+
+			for path, expected := range map[string]string{
+				"/proc/sys/net/ipv4/ip_unprivileged_port_start": "80",
+				"/proc/sys/net/ipv4/conf/eth0.100/rp_filter":    "2",
+			} {
+				value, err := os.ReadFile(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(strings.TrimSpace(string(value))).To(Equal(expected))
+			}
+
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reads the pod network status from the namespace without cached result", func() {
+		_, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.3.1")
+		Expect(err).NotTo(HaveOccurred())
+
+		ocicni, err := initCNI(&fakeExec{}, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+		}
+
+		mac, err := net.ParseMAC("9e:0c:d9:b2:f0:a6")
+		Expect(err).NotTo(HaveOccurred())
+
+		var link netlink.Link
+
+		err = networkNS.Do(func(_ ns.NetNS) error {
+			defer GinkgoRecover()
+
+			lo, err := netlink.LinkByName("lo")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(lo)).To(Succeed())
+
+			link = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0", MTU: 1400, HardwareAddr: mac}, PeerName: "peer0"}
+			Expect(netlink.LinkAdd(link)).To(Succeed())
+
+			for _, addr := range []string{"10.88.0.5/16", "10.89.0.5/16", "fd00::5/64"} {
+				Expect(netlink.AddrAdd(link, &netlink.Addr{IPNet: ensureCIDR(addr)})).To(Succeed())
+			}
+
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// Interfaces which are down still report their addresses
+		for _, up := range []bool{false, true} {
+			if up {
+				err = networkNS.Do(func(_ ns.NetNS) error {
+					return netlink.LinkSetUp(link)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			results, err := ocicni.GetPodNetworkStatus(podNet)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(1))
+
+			r, ok := results[0].Result.(*cniv04.Result)
+			Expect(ok).To(BeTrue())
+			Expect(r.Interfaces).To(Equal([]*cniv04.Interface{{Name: "eth0", Mac: mac.String(), Sandbox: networkNS.Path()}}))
+
+			// All global addresses of both families, without link-local ones
+			addresses := []string{}
+			for _, ip := range r.IPs {
+				addresses = append(addresses, ip.Address.String())
+			}
+			Expect(addresses).To(Equal([]string{"10.88.0.5/16", "10.89.0.5/16", "fd00::5/64"}))
+
+			status, err := getLiveInterfaceStatus(context.Background(), networkNS.Path(), "eth0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status.MTU).To(Equal(1400))
+			Expect(status.Up).To(Equal(up))
+		}
+
+		_, err = getLiveInterfaceStatus(context.Background(), networkNS.Path(), "eth1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reports the live pod network status and its discrepancies", func() {
+		conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		mac, err := net.ParseMAC("9e:0c:d9:b2:f0:a6")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, defaultDst, err := net.ParseCIDR("0.0.0.0/0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin(nil, conf, &cniv04.Result{
+			CNIVersion: "0.4.0",
+			Interfaces: []*cniv04.Interface{{Name: "eth0", Mac: mac.String(), Sandbox: networkNS.Path()}},
+			IPs: []*cniv04.IPConfig{
+				{Interface: cniv04.Int(0), Version: "4", Address: *ensureCIDR("10.88.0.5/16")},
+				{Interface: cniv04.Int(0), Version: "6", Address: *ensureCIDR("fd00::5/64")},
+			},
+			Routes: []*types.Route{
+				{Dst: *defaultDst, GW: net.ParseIP("10.88.0.1")},
+				{Dst: *ensureCIDR("10.90.0.0/16"), GW: net.ParseIP("10.88.0.1")},
+			},
+		})
+
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+		}
+
+		_, err = ocicni.SetUpPod(podNet)
+		Expect(err).NotTo(HaveOccurred())
+
+		// The interface is missing an address and a route of the result
+		// and has an additional address
+		err = networkNS.Do(func(_ ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0", MTU: 1400, HardwareAddr: mac}, PeerName: "peer0"}
+			Expect(netlink.LinkAdd(link)).To(Succeed())
+
+			for _, addr := range []string{"10.88.0.5/16", "10.89.0.5/16"} {
+				Expect(netlink.AddrAdd(link, &netlink.Addr{IPNet: ensureCIDR(addr)})).To(Succeed())
+			}
+
+			peer, err := netlink.LinkByName("peer0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetUp(peer)).To(Succeed())
+			Expect(netlink.LinkSetUp(link)).To(Succeed())
+
+			Expect(netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: net.ParseIP("10.88.0.1")})).To(Succeed())
+
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		reader, ok := ocicni.(LiveStatusReader)
+		Expect(ok).To(BeTrue())
+
+		results, err := reader.GetPodNetworkLiveStatus(context.Background(), podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Name).To(Equal("network2"))
+		Expect(results[0].Result).NotTo(BeNil())
+
+		live := results[0].Interface
+		Expect(live.MAC).To(Equal(mac.String()))
+		Expect(live.MTU).To(Equal(1400))
+		Expect(live.Up).To(BeTrue())
+		Expect(live.Carrier).To(BeTrue())
+		Expect(live.OperState).To(Equal("up"))
+		Expect(live.Gateways).To(Equal([]net.IP{net.ParseIP("10.88.0.1").To4()}))
+		Expect(live.Routes).To(ContainElement(LiveRoute{Dst: *defaultDst, GW: net.ParseIP("10.88.0.1").To4()}))
+
+		Expect(results[0].Discrepancies).To(ConsistOf(
+			"address fd00::5/64 in the CNI result is missing",
+			"address 10.89.0.5/16 is not in the CNI result",
+			"route to 10.90.0.0/16 in the CNI result is missing",
+		))
+		// Nothing was invoked
+		Expect(fake.chkIndex).To(BeZero())
+	})
+
+	It("reports failed checks of cached pods in the background", func() {
+		conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{checkFn: func(containerID, netns string) error {
+			if netns != networkNS.Path() {
+				return fmt.Errorf("unexpected network namespace %q", netns)
+			}
+
+			if containerID == "pod2-id" {
+				return errors.New("interface is gone")
+			}
+
+			return nil
+		}}
+		for range 2 {
+			fake.addPlugin(nil, conf, &cniv04.Result{CNIVersion: "0.4.0"})
+		}
+
+		onFailure := func(*HealthCheckFailure) {}
+		for _, opt := range []Option{
+			WithHealthCheck(0, 1, onFailure),
+			WithHealthCheck(time.Second, 0, onFailure),
+			WithHealthCheck(time.Second, 1, nil),
+		} {
+			_, err = newCNIPlugin(fake, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, []Option{opt})
+			Expect(err).To(HaveOccurred())
+		}
+
+		failures := make(chan HealthCheckFailure, 100)
+		ocicni, err := newCNIPlugin(fake, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, []Option{
+			WithHealthCheck(20*time.Millisecond, 2, func(failure *HealthCheckFailure) {
+				select {
+				case failures <- *failure:
+				default:
+				}
+			}),
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, name := range []string{"pod1", "pod2"} {
+			_, err = ocicni.SetUpPod(PodNetwork{
+				Name:      name,
+				Namespace: "namespace1",
+				ID:        name + "-id",
+				NetNS:     networkNS.Path(),
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		var failure HealthCheckFailure
+		Eventually(failures, 5).Should(Receive(&failure))
+		Expect(failure.Pod.ID).To(Equal("pod2-id"))
+		Expect(failure.Pod.Namespace).To(Equal("namespace1"))
+		Expect(failure.Pod.Name).To(Equal("pod2"))
+		Expect(failure.Pod.NetNS).To(Equal(networkNS.Path()))
+		Expect(failure.Attachment).To(Equal(NetAttachment{Name: "network2", Ifname: "eth0"}))
+		Expect(failure.Err).To(MatchError(ContainSubstring("interface is gone")))
+
+		// Only the broken pod is reported
+		Consistently(func() string {
+			select {
+			case failure := <-failures:
+				return failure.Pod.ID
+			default:
+				return "pod2-id"
+			}
+		}, "100ms").Should(Equal("pod2-id"))
+
+		// Attachments removed from the cache since their pod was listed are
+		// skipped
+		plugin, ok := ocicni.(*cniNetworkPlugin)
+		Expect(ok).To(BeTrue())
+
+		pods, err := listCachedPods(plugin.cniConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pods).To(HaveLen(2))
+		Expect(pods[1].ID).To(Equal("pod2-id"))
+
+		Expect(ocicni.TearDownPod(*pods[1])).To(Succeed())
+		Expect(plugin.checkCachedPod(context.Background(), pods[1])).To(BeEmpty())
+
+		Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+	})
+
+	It("sets up the loopback interface according to the loopback policy", func() {
+		conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+		}
+		loopbackCache := filepath.Join(cacheDir, "results", "cni-loopback-"+podNet.ID+"-lo")
+
+		_, err = newCNIPlugin(&fakeExec{}, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithLoopbackPolicy("bogus")})
+		Expect(err).To(MatchError(ContainSubstring(`unknown loopback policy "bogus"`)))
+
+		// The CNI loopback plugin is invoked and cached
+		fake := &fakeExec{}
+		// DEL runs in reverse order, so the fake plugins cannot check the
+		// configurations
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+
+		ocicni, err := newCNIPlugin(fake, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithLoopbackPolicy(LoopbackPlugin)})
+		Expect(err).NotTo(HaveOccurred())
+
+		results, err := ocicni.SetUpPod(podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(fake.addIndex).To(Equal(2))
+		Expect(loopbackCache).To(BeAnExistingFile())
+
+		results, err = ocicni.GetPodNetworkStatus(podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Name).To(Equal("network2"))
+		Expect(fake.chkIndex).To(Equal(2))
+
+		Expect(ocicni.TearDownPod(podNet)).To(Succeed())
+		Expect(fake.delIndex).To(Equal(2))
+		Expect(loopbackCache).NotTo(BeAnExistingFile())
+		Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+
+		// Loopback is left to the runtime
+		fake = &fakeExec{}
+		fake.addPlugin(nil, conf, &cniv04.Result{CNIVersion: "0.4.0"})
+
+		ocicni, err = newCNIPlugin(fake, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithLoopbackPolicy(LoopbackSkip)})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = ocicni.SetUpPod(podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.addIndex).To(Equal(1))
+		Expect(loopbackCache).NotTo(BeAnExistingFile())
+
+		Expect(ocicni.TearDownPod(podNet)).To(Succeed())
+		Expect(fake.delIndex).To(Equal(1))
+		Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+	})
+
+	It("collects stale loopback attachments in GC", func() {
+		_, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+		}
+		loopbackCache := filepath.Join(cacheDir, "results", "cni-loopback-"+podNet.ID+"-lo")
+
+		fake := &fakeExec{}
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+
+		ocicni, err := newCNIPlugin(fake, cacheDir, "network2", tmpDir, false, []string{"/opt/cni/bin"}, []Option{WithLoopbackPolicy(LoopbackPlugin)})
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		_, err = ocicni.SetUpPod(podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loopbackCache).To(BeAnExistingFile())
+
+		// The loopback attachments of valid pods are kept
+		validPod := podNet
+		Expect(ocicni.GC(context.Background(), []*PodNetwork{&validPod})).To(Succeed())
+		Expect(fake.delIndex).To(BeZero())
+		Expect(loopbackCache).To(BeAnExistingFile())
 
-		for range goroutines {
-			fake.addPlugin(nil, conf, addResult)
+		Expect(ocicni.GC(context.Background(), nil)).To(Succeed())
+		Expect(fake.delIndex).To(Equal(2))
+		Expect(loopbackCache).NotTo(BeAnExistingFile())
+	})
+
+	It("reserves host ports of pods and rejects conflicts", func() {
+		conf := `{
+	"name": "network2",
+	"type": "myplugin",
+	"cniVersion": "0.4.0",
+	"capabilities": {"portMappings": true}
+}`
+		err := os.WriteFile(filepath.Join(tmpDir, "10-network2.conf"), []byte(conf), 0o644)
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		pod1 := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+			RuntimeConfig: map[string]RuntimeConfig{
+				"network2": {PortMappings: []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}},
+			},
 		}
+		_, err = ocicni.SetUpPod(pod1)
+		Expect(err).NotTo(HaveOccurred())
+		lister, ok := ocicni.(HostPortLister)
+		Expect(ok).To(BeTrue())
 
-		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, true, "/opt/cni/bin")
+		Expect(lister.HostPorts()).To(Equal([]HostPortReservation{{
+			PortMapping:  PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+			PodNamespace: "namespace1",
+			PodName:      "pod1",
+			ContainerID:  "1234567890",
+			Network:      "network2",
+			Ifname:       "eth0",
+		}}))
+
+		// A conflicting pod is rejected before invoking plugins
+		pod2 := PodNetwork{
+			Name:      "pod2",
+			Namespace: "namespace1",
+			ID:        "0987654321",
+			NetNS:     networkNS.Path(),
+			RuntimeConfig: map[string]RuntimeConfig{
+				"network2": {PortMappings: []PortMapping{{HostPort: 8080, ContainerPort: 8080, Protocol: "TCP", HostIP: "127.0.0.1"}}},
+			},
+		}
+		_, err = ocicni.SetUpPod(pod2)
+
+		var conflictErr *HostPortConflictError
+		Expect(errors.As(err, &conflictErr)).To(BeTrue())
+		Expect(conflictErr.Owner.PodName).To(Equal("pod1"))
+		Expect(conflictErr.PortMapping.Protocol).To(Equal("tcp"))
+		Expect(fake.addIndex).To(Equal(1))
+		Expect(lister.HostPorts()).To(HaveLen(1))
+
+		// Reservations are rebuilt from the CNI cache
+		Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+
+		ocicni, err = initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
 		Expect(err).NotTo(HaveOccurred())
 
 		defer func() {
 			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
 		}()
 
-		Eventually(func() bool {
-			return ocicni.Status() == nil
-		}, 5*time.Second, 100*time.Millisecond).Should(BeTrue())
+		lister, ok = ocicni.(HostPortLister)
+		Expect(ok).To(BeTrue())
 
-		var wg sync.WaitGroup
+		Expect(lister.HostPorts()).To(HaveLen(1))
+		Expect(lister.HostPorts()[0].PodName).To(Equal("pod1"))
 
-		wg.Add(goroutines)
+		// Tearing down the owner releases its host ports
+		Expect(ocicni.TearDownPod(pod1)).To(Succeed())
+		Expect(lister.HostPorts()).To(BeEmpty())
 
-		errCh := make(chan error, goroutines*2)
+		_, err = ocicni.SetUpPod(pod2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lister.HostPorts()).To(HaveLen(1))
 
-		for i := range goroutines {
-			go func() {
-				defer wg.Done()
+		// GC releases the host ports of pods which are gone
+		Expect(ocicni.GC(context.Background(), nil)).To(Succeed())
+		Expect(lister.HostPorts()).To(BeEmpty())
+	})
 
-				podNet := PodNetwork{
-					Name:      fmt.Sprintf("pod%d", i),
-					Namespace: "namespace1",
-					ID:        fmt.Sprintf("pod-id-%d", i),
-					NetNS:     networkNS.Path(),
-				}
+	It("normalizes host port reservations loaded from the CNI cache", func() {
+		conf := `{"cniVersion": "0.4.0", "name": "network2", "plugins": [{"type": "myplugin", "capabilities": {"portMappings": true}}]}`
+		err := os.WriteFile(filepath.Join(tmpDir, "10-network2.conflist"), []byte(conf), 0o644)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Mappings cached before normalization may use any protocol case or none
+		for _, cached := range []struct{ id, protocol, hostIP string }{
+			{"1234567890", "TCP", "127.0.0.1"},
+			{"0987654321", "", "127.0.0.2"},
+		} {
+			cachedData := fmt.Sprintf(`{
+	"kind": "cniCacheV1",
+	"config": "%s",
+	"containerId": "%s",
+	"ifName": "eth0",
+	"networkName": "network2",
+	"cniArgs": [["K8S_POD_NAMESPACE", "namespace1"], ["K8S_POD_NAME", "pod-%s"]],
+	"capabilityArgs": {"portMappings": [{"hostPort": 8080, "containerPort": 80, "protocol": "%s", "hostIP": "%s"}]},
+	"result": {"cniVersion": "0.4.0"}
+}`, base64.StdEncoding.EncodeToString([]byte(conf)), cached.id, cached.id, cached.protocol, cached.hostIP)
+
+			Expect(os.MkdirAll(filepath.Join(cacheDir, "results"), 0o700)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(cacheDir, "results", "network2-"+cached.id+"-eth0"), []byte(cachedData), 0o644)).To(Succeed())
+		}
 
-				_, setupErr := ocicni.SetUpPod(podNet)
-				if setupErr != nil {
-					errCh <- setupErr
+		fake := &fakeExec{}
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
 
-					return
-				}
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
 
-				teardownErr := ocicni.TearDownPod(podNet)
-				if teardownErr != nil {
-					errCh <- teardownErr
-				}
-			}()
+		lister, ok := ocicni.(HostPortLister)
+		Expect(ok).To(BeTrue())
+		Expect(lister.HostPorts()).To(ConsistOf(
+			HaveField("PortMapping", PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "127.0.0.1"}),
+			HaveField("PortMapping", PortMapping{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: "127.0.0.2"}),
+		))
+
+		for _, hostIP := range []string{"127.0.0.1", "127.0.0.2"} {
+			_, err = ocicni.SetUpPod(PodNetwork{
+				Name:      "pod",
+				Namespace: "namespace1",
+				ID:        "1111111111",
+				NetNS:     networkNS.Path(),
+				RuntimeConfig: map[string]RuntimeConfig{
+					"network2": {PortMappings: []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp", HostIP: hostIP}}},
+				},
+			})
+
+			var conflictErr *HostPortConflictError
+			Expect(errors.As(err, &conflictErr)).To(BeTrue())
+			Expect(conflictErr.Owner.PodNamespace).To(Equal("namespace1"))
 		}
 
-		wg.Wait()
-		close(errCh)
+		Expect(fake.addIndex).To(BeZero())
+	})
 
-		for err := range errCh {
+	It("does not reserve host ports on networks without the portMappings capability", func() {
+		_, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		for _, id := range []string{"1234567890", "0987654321"} {
+			_, err = ocicni.SetUpPod(PodNetwork{
+				Name:      "pod-" + id,
+				Namespace: "namespace1",
+				ID:        id,
+				NetNS:     networkNS.Path(),
+				RuntimeConfig: map[string]RuntimeConfig{
+					"network2": {PortMappings: []PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}},
+				},
+			})
 			Expect(err).NotTo(HaveOccurred())
 		}
+
+		lister, ok := ocicni.(HostPortLister)
+		Expect(ok).To(BeTrue())
+		Expect(lister.HostPorts()).To(BeEmpty())
+	})
+
+	It("does not block configuration reloads and other pods while a plugin runs", func() {
+		conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin(nil, conf, &cniv04.Result{CNIVersion: "0.4.0"})
+		fake.addPlugin(nil, conf, &cniv04.Result{CNIVersion: "0.4.0"})
+
+		wait := make(chan struct{})
+		fake.plugins[0].wait = wait
+
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		plugin, ok := ocicni.(*cniNetworkPlugin)
+		Expect(ok).To(BeTrue())
+
+		done := make(chan error, 1)
+
+		go func() {
+			_, err := ocicni.SetUpPod(PodNetwork{
+				Name:      "pod1",
+				Namespace: "namespace1",
+				ID:        "1234567890",
+				NetNS:     networkNS.Path(),
+			})
+			done <- err
+		}()
+
+		// Wait until the plugin of the first pod is blocked
+		Eventually(func() int {
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			return fake.addIndex
+		}, 5*time.Second).Should(Equal(1))
+
+		synced := make(chan error, 1)
+
+		go func() {
+			synced <- plugin.syncNetworkConfig(context.Background())
+		}()
+
+		Eventually(synced, 5*time.Second).Should(Receive(BeNil()))
+
+		_, err = ocicni.SetUpPod(PodNetwork{
+			Name:      "pod2",
+			Namespace: "namespace1",
+			ID:        "0987654321",
+			NetNS:     networkNS.Path(),
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Consistently(done).ShouldNot(Receive())
+
+		close(wait)
+		Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+	})
+
+	It("reports in-flight pod operations", func() {
+		conf, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin(nil, conf, &cniv04.Result{CNIVersion: "0.4.0"})
+
+		wait := make(chan struct{})
+		fake.plugins[0].wait = wait
+
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		debugger, ok := ocicni.(Debugger)
+		Expect(ok).To(BeTrue())
+
+		Expect(debugger.InFlight()).To(BeEmpty())
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+		}
+
+		done := make(chan error, 1)
+
+		go func() {
+			_, err := ocicni.SetUpPod(podNet)
+			done <- err
+		}()
+
+		Eventually(debugger.InFlight, 5*time.Second).Should(ConsistOf(And(
+			HaveField("PodKey", "namespace1_pod1"),
+			HaveField("Refcount", uint(1)),
+			HaveField("Operation", OperationAdd),
+			HaveField("Network", "network2"),
+			HaveField("Plugin", "/opt/cni/bin/myplugin"),
+			HaveField("Started", Not(BeZero())),
+		)))
+
+		debug := debugger.Debug()
+		Expect(debug.GCRunning).To(BeFalse())
+		Expect(debug.InFlight).To(HaveLen(1))
+
+		close(wait)
+		Eventually(done, 5*time.Second).Should(Receive(BeNil()))
+		Expect(debugger.InFlight()).To(BeEmpty())
+	})
+
+	It("attaches and detaches single networks of a running pod", func() {
+		_, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = writeConfig(tmpDir, "20-network3.conf", "network3", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+		fake.addPlugin(nil, "", &cniv04.Result{CNIVersion: "0.4.0"})
+
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+		}
+		_, err = ocicni.SetUpPod(podNet)
+		Expect(err).NotTo(HaveOccurred())
+
+		ctx := context.Background()
+		attacher, ok := ocicni.(NetworkAttacher)
+		Expect(ok).To(BeTrue())
+
+		result, err := attacher.AttachNetwork(ctx, podNet, NetAttachment{Name: "network3"}, RuntimeConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Name).To(Equal("network3"))
+		Expect(result.Ifname).To(Equal("eth1"))
+		Expect(filepath.Join(cacheDir, "results", "network3-1234567890-eth1")).To(BeAnExistingFile())
+
+		// Duplicate attachments are refused without running any plugin
+		_, err = attacher.AttachNetwork(ctx, podNet, NetAttachment{Name: "network3"}, RuntimeConfig{})
+		Expect(err).To(MatchError(ContainSubstring("already attached")))
+		_, err = attacher.AttachNetwork(ctx, podNet, NetAttachment{Name: "network3", Ifname: "eth0"}, RuntimeConfig{})
+		Expect(err).To(MatchError(ContainSubstring("already used by network \"network2\"")))
+		Expect(fake.addIndex).To(Equal(2))
+
+		err = attacher.DetachNetwork(ctx, podNet, NetAttachment{Name: "network3"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.delIndex).To(Equal(1))
+		Expect(filepath.Join(cacheDir, "results", "network3-1234567890-eth1")).NotTo(BeAnExistingFile())
+
+		err = attacher.DetachNetwork(ctx, podNet, NetAttachment{Name: "network3"})
+		Expect(err).To(MatchError(ContainSubstring("not attached")))
+
+		// Only the remaining attachment is torn down
+		err = ocicni.TearDownPod(podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.delIndex).To(Equal(2))
+		Expect(filepath.Join(cacheDir, "results", "network2-1234567890-eth0")).NotTo(BeAnExistingFile())
 	})
 
 	It("sets up and tears down a pod using specified networks", func() {
@@ -1019,6 +2675,87 @@ var _ = Describe("ocicni operations", func() {
 		Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
 	})
 
+	It("designates a primary network and returns its IPs", func() {
+		_, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = writeConfig(tmpDir, "20-network3.conf", "network3", "myplugin", "0.4.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin(nil, "", &cniv04.Result{
+			CNIVersion: "0.4.0",
+			Interfaces: []*cniv04.Interface{{Name: "eth0", Sandbox: networkNS.Path()}},
+			IPs:        []*cniv04.IPConfig{{Interface: cniv04.Int(0), Version: "4", Address: *ensureCIDR("1.1.1.2/24")}},
+			DNS:        types.DNS{Nameservers: []string{"1.1.1.1", "10.0.0.53"}, Search: []string{"example.com"}},
+		})
+		fake.addPlugin(nil, "", &cniv04.Result{
+			CNIVersion: "0.4.0",
+			Interfaces: []*cniv04.Interface{{Name: "veth0"}, {Name: "eth1", Sandbox: networkNS.Path()}},
+			IPs: []*cniv04.IPConfig{
+				{Interface: cniv04.Int(0), Version: "4", Address: *ensureCIDR("10.0.0.1/24")},
+				{Interface: cniv04.Int(1), Version: "6", Address: *ensureCIDR("fd00::2/64")},
+				{Interface: cniv04.Int(1), Version: "4", Address: *ensureCIDR("10.0.0.2/24")},
+			},
+			DNS: types.DNS{Nameservers: []string{"10.0.0.53"}, Domain: "cluster.local", Options: []string{"ndots:5"}},
+		})
+
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+			Networks: []NetAttachment{
+				{Name: "network2"},
+				{Name: "network3", Primary: true},
+			},
+		}
+		results, err := ocicni.SetUpPod(podNet)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results[0].Primary).To(BeFalse())
+		Expect(results[1].Primary).To(BeTrue())
+
+		ips, err := NetResults(results).PrimaryIPs(IPFamilyIPv4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(Equal([]net.IP{net.ParseIP("10.0.0.2").To4(), net.ParseIP("fd00::2")}))
+
+		ips, err = NetResults(results).PrimaryIPs(IPFamilyIPv6)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(Equal([]net.IP{net.ParseIP("fd00::2"), net.ParseIP("10.0.0.2").To4()}))
+
+		// DNS settings of the primary network come first
+		dns, err := NetResults(results).DNS()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dns).To(Equal(&DNSConfig{
+			Servers:  []string{"10.0.0.53", "1.1.1.1"},
+			Searches: []string{"cluster.local", "example.com"},
+			Options:  []string{"ndots:5"},
+		}))
+
+		dns, err = NetResults{}.DNS()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dns).To(BeNil())
+
+		// Without an explicit primary, the default network is primary
+		tmp, ok := ocicni.(*cniNetworkPlugin)
+		Expect(ok).To(BeTrue())
+
+		podNet.Networks = []NetAttachment{{Name: "network3"}, {Name: "network2"}}
+		Expect(tmp.fillPodNetworks(&podNet)).To(Succeed())
+		Expect(podNet.Networks[1].Primary).To(BeTrue())
+
+		// Only a single primary network is allowed
+		podNet.Networks = []NetAttachment{{Name: "network3", Primary: true}, {Name: "network2", Primary: true}}
+		_, err = ocicni.SetUpPod(podNet)
+		Expect(err).To(MatchError(ContainSubstring("both marked as primary")))
+	})
+
 	It("correctly issues a GC for the default network", func() {
 		_, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "1.1.0")
 		Expect(err).NotTo(HaveOccurred())
@@ -1086,6 +2823,35 @@ var _ = Describe("ocicni operations", func() {
 		Expect(fake.gcIndex).To(Equal(len(fake.plugins)))
 	})
 
+	It("skips the GC of networks of pods with invalid attachments", func() {
+		_, _, err := writeConfig(tmpDir, "10-network2.conf", "network2", "myplugin", "1.1.0")
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeExec{}
+		fake.addPlugin(nil, "", nil)
+
+		ocicni, err := initCNI(fake, cacheDir, "network2", tmpDir, false, "/opt/cni/bin")
+		Expect(err).NotTo(HaveOccurred())
+
+		defer func() {
+			Expect(ocicni.Shutdown()).NotTo(HaveOccurred())
+		}()
+
+		podNet := PodNetwork{
+			Name:      "pod1",
+			Namespace: "namespace1",
+			ID:        "1234567890",
+			NetNS:     networkNS.Path(),
+			Networks: []NetAttachment{
+				{Name: "network2", Ifname: "net1"},
+				{Name: "network2", Ifname: "net1"},
+			},
+		}
+		err = ocicni.GC(context.Background(), []*PodNetwork{&podNet})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fake.gcIndex).To(Equal(0))
+	})
+
 	Context("when tearing down a pod using cached info", func() {
 		const (
 			containerID    string = "1234567890"
@@ -1143,8 +2909,8 @@ var _ = Describe("ocicni operations", func() {
 
 		It("uses the specified networks", func() {
 			podNet.Networks = []NetAttachment{
-				{netName1, ifname1},
-				{netName2, ifname2},
+				{Name: netName1, Ifname: ifname1},
+				{Name: netName2, Ifname: ifname2},
 			}
 
 			err := ocicni.TearDownPod(podNet)
@@ -1158,20 +2924,45 @@ var _ = Describe("ocicni operations", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(fake.delIndex).To(Equal(len(fake.plugins)))
 		})
+		It("returns the plugin invocations of a dry run using the cached networks", func() {
+			podNet.Networks = []NetAttachment{}
+			dryRunner, ok := ocicni.(DryRunner)
+			Expect(ok).To(BeTrue())
+
+			results, err := dryRunner.TearDownPodDryRun(context.Background(), podNet)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fake.delIndex).To(BeZero())
+			Expect(results).To(HaveLen(2))
+
+			for i, ifname := range []string{ifname1, ifname2} {
+				Expect(results[i].Ifname).To(Equal(ifname))
+				Expect(results[i].Invocations).To(HaveLen(1))
+				Expect(results[i].Invocations[0].Env).To(ContainElements("CNI_COMMAND=DEL", "CNI_IFNAME="+ifname))
+
+				// The cached result is passed as the prevResult
+				stdin := map[string]any{}
+				Expect(json.Unmarshal(results[i].Invocations[0].Stdin, &stdin)).To(Succeed())
+				Expect(stdin).To(HaveKeyWithValue("prevResult", HaveKeyWithValue("cniVersion", "0.4.0")))
+			}
+
+			// The cache is left untouched
+			_, err = os.Stat(filepath.Join(cacheDir, "results", fmt.Sprintf("%s-%s-%s", netName1, containerID, ifname1)))
+			Expect(err).NotTo(HaveOccurred())
+		})
 		It("verifies that network operations can be locked for a pod using cached networks", func() {
 			podNet.Networks = []NetAttachment{}
 			tmp, ok := ocicni.(*cniNetworkPlugin)
 			Expect(ok).To(BeTrue())
-			Expect(tmp.pods).To(BeEmpty())
+			Expect(tmp.podLockCount()).To(BeZero())
 			tmp.podLock(&podNet)
-			Expect(tmp.pods).To(HaveLen(1))
+			Expect(tmp.podLockCount()).To(Equal(1))
 		})
 		It("verifies that network operations can be unlocked for a pod using cached networks", func() {
 			podNet.Networks = []NetAttachment{}
 			tmp, ok := ocicni.(*cniNetworkPlugin)
 			Expect(ok).To(BeTrue())
 			tmp.podUnlock(&podNet)
-			Expect(tmp.pods).To(BeEmpty())
+			Expect(tmp.podLockCount()).To(BeZero())
 		})
 	})
 
@@ -0,0 +1,37 @@
+package ocicni
+
+// Option configures optional behavior of the CNI plugin returned by
+// InitCNIWithOptions.
+type Option func(*cniNetworkPlugin) error
+
+// InitCNIWithOptions works like InitCNIWithCache except that it takes the
+// binary directories as a slice and accepts additional options.
+func InitCNIWithOptions(defaultNetName, confDir, cacheDir string, binDirs []string, opts ...Option) (CNIPlugin, error) {
+	return newCNIPlugin(nil, cacheDir, defaultNetName, confDir, true, binDirs, opts)
+}
+
+// WithFileLocking enables cross-process locking of pod network operations.
+// Lock files are created in a "locks" directory below the CNI cache
+// directory: one per container ID, which serializes operations on the same
+// container, and one for GC, which is held shared by pod operations and
+// exclusively by GC. This allows several processes embedding ocicni and
+// sharing a cache directory to coordinate with each other. The file locks
+// are acquired after the in-memory locks of the plugin.
+func WithFileLocking() Option {
+	return func(plugin *cniNetworkPlugin) error {
+		plugin.useFileLocks = true
+
+		return nil
+	}
+}
+
+// WithCNIArgsFromEnv passes the key/value pairs of the CNI_ARGS environment
+// variable of the process to the plugins of every attachment, in addition to
+// the args of the pod and the attachment.
+func WithCNIArgsFromEnv() Option {
+	return func(plugin *cniNetworkPlugin) error {
+		plugin.propagateEnvArgs = true
+
+		return nil
+	}
+}
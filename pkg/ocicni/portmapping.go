@@ -0,0 +1,137 @@
+package ocicni
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxPort = 65535
+
+	defaultPortMappingProtocol = "tcp"
+)
+
+// describePortMapping returns a description of a port mapping for use in
+// errors, like "192.168.0.1:8080->80/tcp".
+func describePortMapping(pm *PortMapping) string {
+	return fmt.Sprintf("%s->%d/%s", net.JoinHostPort(pm.HostIP, strconv.Itoa(int(pm.HostPort))), pm.ContainerPort, pm.Protocol)
+}
+
+// normalizePortMappings validates port mappings and returns them with
+// lowercase protocols, defaulting to tcp. The host IP of a mapping must have
+// the family of one of the static IPs, if any are given.
+func normalizePortMappings(mappings []PortMapping, ips []string) ([]PortMapping, error) {
+	if len(mappings) == 0 {
+		return mappings, nil
+	}
+
+	var hasIPv4, hasIPv6 bool
+
+	for _, ip := range ips {
+		addr, _, _ := strings.Cut(ip, "/")
+		if parsed := net.ParseIP(addr); parsed != nil && parsed.To4() != nil {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
+		}
+	}
+
+	normalized := make([]PortMapping, 0, len(mappings))
+
+	for i := range mappings {
+		pm := mappings[i]
+
+		pm.Protocol = strings.ToLower(pm.Protocol)
+		if pm.Protocol == "" {
+			pm.Protocol = defaultPortMappingProtocol
+		}
+
+		switch pm.Protocol {
+		case "tcp", "udp", "sctp":
+		default:
+			return nil, fmt.Errorf("invalid port mapping %s: unknown protocol %q", describePortMapping(&mappings[i]), mappings[i].Protocol)
+		}
+
+		if pm.HostPort < 1 || pm.HostPort > maxPort {
+			return nil, fmt.Errorf("invalid port mapping %s: host port out of range", describePortMapping(&pm))
+		}
+
+		if pm.ContainerPort < 1 || pm.ContainerPort > maxPort {
+			return nil, fmt.Errorf("invalid port mapping %s: container port out of range", describePortMapping(&pm))
+		}
+
+		if pm.HostIP != "" {
+			hostIP := net.ParseIP(pm.HostIP)
+			if hostIP == nil {
+				return nil, fmt.Errorf("invalid port mapping %s: unable to parse host IP", describePortMapping(&pm))
+			}
+
+			isIPv4 := hostIP.To4() != nil
+			if len(ips) > 0 && ((isIPv4 && !hasIPv4) || (!isIPv4 && !hasIPv6)) {
+				return nil, fmt.Errorf("invalid port mapping %s: host IP family does not match the pod IPs %v", describePortMapping(&pm), ips)
+			}
+		}
+
+		normalized = append(normalized, pm)
+	}
+
+	return normalized, nil
+}
+
+// portMappingsConflict reports whether two port mappings bind the same host
+// port. A mapping without host IP, or with an unspecified one, binds the
+// port on all addresses of its family.
+func portMappingsConflict(a, b *PortMapping) bool {
+	if a.HostPort != b.HostPort || a.Protocol != b.Protocol {
+		return false
+	}
+
+	if a.HostIP == "" || b.HostIP == "" {
+		return true
+	}
+
+	ipA, ipB := net.ParseIP(a.HostIP), net.ParseIP(b.HostIP)
+	if (ipA.To4() != nil) != (ipB.To4() != nil) {
+		return false
+	}
+
+	return ipA.Equal(ipB) || ipA.IsUnspecified() || ipB.IsUnspecified()
+}
+
+// validatePodPortMappings validates the port mappings of all attachments of
+// a pod and ensures that no two of them bind the same host port.
+func validatePodPortMappings(podNetwork *PodNetwork) error {
+	all := []PortMapping{}
+
+	for i := range podNetwork.Networks {
+		runtimeConfig := podNetwork.runtimeConfigFor(&podNetwork.Networks[i])
+
+		ips, err := staticIPs(runtimeConfig)
+		if err != nil {
+			return err
+		}
+
+		mappings, err := normalizePortMappings(runtimeConfig.PortMappings, ips)
+		if err != nil {
+			return fmt.Errorf("network %q: %w", podNetwork.Networks[i].Name, err)
+		}
+
+		for j := range mappings {
+			for k := range all {
+				if mappings[j] == all[k] {
+					return fmt.Errorf("duplicate port mapping %s", describePortMapping(&mappings[j]))
+				}
+
+				if portMappingsConflict(&mappings[j], &all[k]) {
+					return fmt.Errorf("port mapping %s conflicts with port mapping %s", describePortMapping(&mappings[j]), describePortMapping(&all[k]))
+				}
+			}
+
+			all = append(all, mappings[j])
+		}
+	}
+
+	return nil
+}
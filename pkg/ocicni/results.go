@@ -0,0 +1,164 @@
+package ocicni
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	cniv1 "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// IPFamily is an IP address family.
+type IPFamily string
+
+const (
+	// IPFamilyIPv4 is the IPv4 address family.
+	IPFamilyIPv4 IPFamily = "IPv4"
+	// IPFamilyIPv6 is the IPv6 address family.
+	IPFamilyIPv6 IPFamily = "IPv6"
+)
+
+// NetResults are the results of all network attachments of a pod, as
+// returned by SetUpPod and GetPodNetworkStatus.
+type NetResults []NetResult
+
+// Primary returns the result of the primary attachment. If no result is
+// marked as primary, the first result is returned. It returns nil if there
+// are no results.
+func (results NetResults) Primary() *NetResult {
+	for i := range results {
+		if results[i].Primary {
+			return &results[i]
+		}
+	}
+
+	if len(results) == 0 {
+		return nil
+	}
+
+	return &results[0]
+}
+
+// PrimaryIPs returns the primary IPs of the pod: the first IPv4 and the first
+// IPv6 address of the primary attachment's sandbox interfaces, with the
+// address of the preferred family first. The result contains one address for
+// single-stack pods, and two for dual-stack pods.
+func (results NetResults) PrimaryIPs(preferred IPFamily) ([]net.IP, error) {
+	primary := results.Primary()
+	if primary == nil {
+		return nil, errors.New("no network results")
+	}
+
+	if primary.Result == nil {
+		return nil, fmt.Errorf("network %q has no result", primary.Name)
+	}
+
+	result, err := cniv1.NewResultFromResult(primary.Result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert result of network %q: %w", primary.Name, err)
+	}
+
+	var ipv4, ipv6 net.IP
+
+	for _, ipConfig := range result.IPs {
+		// Skip addresses of host side interfaces
+		if ipConfig.Interface != nil && *ipConfig.Interface >= 0 && *ipConfig.Interface < len(result.Interfaces) &&
+			result.Interfaces[*ipConfig.Interface].Sandbox == "" {
+			continue
+		}
+
+		ip := ipConfig.Address.IP
+		if ip.To4() != nil {
+			if ipv4 == nil {
+				ipv4 = ip.To4()
+			}
+		} else if ipv6 == nil {
+			ipv6 = ip
+		}
+	}
+
+	ips := []net.IP{}
+
+	switch preferred {
+	case IPFamilyIPv6:
+		ips = appendIP(ips, ipv6)
+		ips = appendIP(ips, ipv4)
+	case IPFamilyIPv4:
+		ips = appendIP(ips, ipv4)
+		ips = appendIP(ips, ipv6)
+	default:
+		return nil, fmt.Errorf("unknown IP family %q", preferred)
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("network %q has no IPs", primary.Name)
+	}
+
+	return ips, nil
+}
+
+// DNS returns the DNS settings returned by the plugins, merged over all
+// results with those of the primary attachment first. The domain of a result
+// is used as a search domain. It returns nil if no result contains DNS
+// settings.
+func (results NetResults) DNS() (*DNSConfig, error) {
+	ordered := NetResults{}
+
+	primary := results.Primary()
+	if primary != nil {
+		ordered = append(ordered, *primary)
+	}
+
+	for i := range results {
+		if &results[i] != primary {
+			ordered = append(ordered, results[i])
+		}
+	}
+
+	dns := &DNSConfig{}
+
+	for i := range ordered {
+		if ordered[i].Result == nil {
+			continue
+		}
+
+		result, err := cniv1.NewResultFromResult(ordered[i].Result)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert result of network %q: %w", ordered[i].Name, err)
+		}
+
+		dns.Servers = appendUnique(dns.Servers, result.DNS.Nameservers...)
+
+		if result.DNS.Domain != "" {
+			dns.Searches = appendUnique(dns.Searches, result.DNS.Domain)
+		}
+
+		dns.Searches = appendUnique(dns.Searches, result.DNS.Search...)
+		dns.Options = appendUnique(dns.Options, result.DNS.Options...)
+	}
+
+	if len(dns.Servers) == 0 && len(dns.Searches) == 0 && len(dns.Options) == 0 {
+		return nil, nil //nolint:nilnil // no DNS settings is not an error
+	}
+
+	return dns, nil
+}
+
+func appendUnique(values []string, add ...string) []string {
+	for _, value := range add {
+		if !slices.Contains(values, value) {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	if ip == nil {
+		return ips
+	}
+
+	return append(ips, ip)
+}
@@ -0,0 +1,165 @@
+package ocicni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ipamRanges returns the address ranges of the IPAM configuration of the
+// network, in the host-local format: either "ranges", or "subnet" with
+// optional "rangeStart" and "rangeEnd". It returns nil if no plugin of the
+// network configures ranges.
+func (network *cniNetwork) ipamRanges() [][]IpRange {
+	if network.config == nil {
+		return nil
+	}
+
+	ranges := [][]IpRange{}
+
+	for _, plugin := range network.config.Plugins {
+		conf := struct {
+			IPAM struct {
+				IpRange
+
+				Ranges [][]IpRange `json:"ranges"`
+			} `json:"ipam"`
+		}{}
+
+		if err := json.Unmarshal(plugin.Bytes, &conf); err != nil {
+			continue
+		}
+
+		ranges = append(ranges, conf.IPAM.Ranges...)
+
+		if conf.IPAM.Subnet != "" {
+			ranges = append(ranges, []IpRange{conf.IPAM.IpRange})
+		}
+	}
+
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	return ranges
+}
+
+// ipRangeContains reports whether ip is in the subnet of the range, and
+// between its start and end if given.
+func ipRangeContains(ipRange *IpRange, ip net.IP) (bool, error) {
+	_, subnet, err := net.ParseCIDR(ipRange.Subnet)
+	if err != nil {
+		return false, fmt.Errorf("invalid IP range subnet %q: %w", ipRange.Subnet, err)
+	}
+
+	if !subnet.Contains(ip) {
+		return false, nil
+	}
+
+	for _, bound := range []struct {
+		value string
+		sign  int
+	}{{ipRange.RangeStart, -1}, {ipRange.RangeEnd, 1}} {
+		if bound.value == "" {
+			continue
+		}
+
+		boundIP := net.ParseIP(bound.value)
+		if boundIP == nil {
+			return false, fmt.Errorf("invalid IP range bound %q", bound.value)
+		}
+
+		if bytes.Compare(ip.To16(), boundIP.To16()) == bound.sign {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// validateStaticIP checks that ip is in one of the ranges, and that the
+// ranges contain addresses of its family. The source describes the ranges in
+// errors.
+func validateStaticIP(ip net.IP, ranges [][]IpRange, source string) error {
+	isIPv4 := ip.To4() != nil
+	hasFamily := false
+
+	for _, rangeSet := range ranges {
+		for i := range rangeSet {
+			contained, err := ipRangeContains(&rangeSet[i], ip)
+			if err != nil {
+				return err
+			}
+
+			if contained {
+				return nil
+			}
+
+			if _, subnet, err := net.ParseCIDR(rangeSet[i].Subnet); err == nil && (subnet.IP.To4() != nil) == isIPv4 {
+				hasFamily = true
+			}
+		}
+	}
+
+	family := IPFamilyIPv6
+	if isIPv4 {
+		family = IPFamilyIPv4
+	}
+
+	if !hasFamily {
+		return fmt.Errorf("static IP %s is %s, but the %s contain no %s range", ip, family, source, family)
+	}
+
+	return fmt.Errorf("static IP %s is outside of the %s", ip, source)
+}
+
+// validateStaticIPs checks the static IPs of an attachment against the IP
+// ranges requested by its runtime config, or if there are none, against the
+// IPAM ranges of the network configuration.
+func validateStaticIPs(network *cniNetwork, runtimeConfig *RuntimeConfig) error {
+	ips, err := staticIPs(runtimeConfig)
+	if err != nil || len(ips) == 0 {
+		return err
+	}
+
+	ranges := runtimeConfig.IpRanges
+	source := "requested IP ranges"
+
+	if len(ranges) == 0 {
+		ranges = network.ipamRanges()
+		source = "IPAM ranges of the network"
+	}
+
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	for _, ip := range ips {
+		addr, _, _ := strings.Cut(ip, "/")
+
+		if err := validateStaticIP(net.ParseIP(addr), ranges, source); err != nil {
+			return fmt.Errorf("network %q: %w", network.name, err)
+		}
+	}
+
+	return nil
+}
+
+// validatePodStaticIPs checks the static IPs of all attachments of a pod
+// before any of them is set up, see validateStaticIPs.
+func validatePodStaticIPs(podNetwork *PodNetwork, networks map[string]*cniNetwork) error {
+	for i := range podNetwork.Networks {
+		network, ok := networks[podNetwork.Networks[i].Name]
+		if !ok {
+			continue
+		}
+
+		if err := validateStaticIPs(network, podNetwork.runtimeConfigFor(&podNetwork.Networks[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package ocicni
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cniversion "github.com/containernetworking/cni/pkg/version"
+)
+
+// NetworkState is the readiness of a network as reported by StatusAll.
+type NetworkState string
+
+const (
+	// NetworkReady means that the plugins of the network reported that
+	// they are ready to set up pods.
+	NetworkReady NetworkState = "ready"
+	// NetworkNotReady means that a plugin of the network reported an
+	// error, or did not respond in time.
+	NetworkNotReady NetworkState = "not-ready"
+	// NetworkStatusUnsupported means that the cniVersion of the network
+	// predates the STATUS verb, so its readiness is unknown.
+	NetworkStatusUnsupported NetworkState = "unsupported"
+)
+
+const (
+	// defaultStatusTimeout is the time each network has to answer STATUS
+	// in StatusAll, and shared STATUS invocations have to complete.
+	defaultStatusTimeout = 10 * time.Second
+
+	// statusMinVersion is the first CNI version with the STATUS verb.
+	statusMinVersion = "1.1.0"
+)
+
+// NetworkStatus is the STATUS of a network as reported by StatusAll.
+type NetworkStatus struct {
+	// State is the readiness of the network.
+	State NetworkState
+	// Err is the error reported by the network if it is not ready.
+	Err error
+}
+
+// WithStatusTimeout sets the time each network has to answer STATUS in
+// StatusAll, and the time a STATUS invocation shared by concurrent callers of
+// Status has to complete, see WithStatusCacheTTL. It defaults to 10 seconds.
+func WithStatusTimeout(timeout time.Duration) Option {
+	return func(plugin *cniNetworkPlugin) error {
+		if timeout <= 0 {
+			return fmt.Errorf("invalid status timeout %v", timeout)
+		}
+
+		plugin.statusTimeout = timeout
+
+		return nil
+	}
+}
+
+// WithStatusCacheTTL caches the STATUS result of the default network in
+// Status for the given time, so that frequent polling does not invoke the
+// plugins each time. Concurrent callers share a single STATUS invocation. The
+// cache is invalidated when the default network changes. Caching is disabled
+// by default.
+func WithStatusCacheTTL(ttl time.Duration) Option {
+	return func(plugin *cniNetworkPlugin) error {
+		if ttl < 0 {
+			return fmt.Errorf("invalid status cache TTL %v", ttl)
+		}
+
+		plugin.statusCache.ttl = ttl
+
+		return nil
+	}
+}
+
+// statusCache caches the STATUS result of the default network and
+// deduplicates concurrent STATUS invocations.
+type statusCache struct {
+	mu sync.Mutex
+
+	// ttl is how long results are cached, zero disables the cache.
+	ttl time.Duration
+
+	// generation is incremented on invalidation, so that invocations
+	// started before do not populate the cache.
+	generation uint64
+
+	err     error
+	expires time.Time
+
+	// call is the STATUS invocation in flight, if any.
+	call *statusCall
+}
+
+// statusCall is a STATUS invocation shared by concurrent callers.
+type statusCall struct {
+	done chan struct{}
+	err  error
+}
+
+// get returns the cached STATUS result if it has not expired. Otherwise it
+// invokes statusFn, or waits for the invocation of another caller. Shared
+// invocations are detached from the context of the caller which started them
+// and bounded by timeout, so that canceling one caller does not fail the
+// others. Each caller only waits until its own context is done.
+func (c *statusCache) get(ctx context.Context, timeout time.Duration, statusFn func(context.Context) error) error {
+	if c.ttl == 0 {
+		return statusFn(ctx)
+	}
+
+	c.mu.Lock()
+
+	if time.Now().Before(c.expires) {
+		err := c.err
+		c.mu.Unlock()
+
+		return err
+	}
+
+	call := c.call
+	if call == nil {
+		call = &statusCall{done: make(chan struct{})}
+		c.call = call
+
+		go c.run(context.WithoutCancel(ctx), timeout, call, c.generation, statusFn)
+	}
+
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run invokes statusFn for a shared call and caches its result, unless the
+// cache was invalidated since the call was started.
+func (c *statusCache) run(ctx context.Context, timeout time.Duration, call *statusCall, generation uint64, statusFn func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := statusFn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %v: %w", timeout, err)
+	}
+
+	c.mu.Lock()
+
+	call.err = err
+
+	if c.generation == generation {
+		c.err = err
+		c.expires = time.Now().Add(c.ttl)
+	}
+
+	if c.call == call {
+		c.call = nil
+	}
+
+	c.mu.Unlock()
+
+	close(call.done)
+}
+
+// invalidate drops the cached STATUS result, and detaches the invocation in
+// flight from later callers.
+func (c *statusCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.expires = time.Time{}
+	c.call = nil
+}
+
+// networkStatus runs STATUS against a network within the status timeout.
+func (plugin *cniNetworkPlugin) networkStatus(ctx context.Context, network *cniNetwork) NetworkStatus {
+	supported, err := cniversion.GreaterThanOrEqualTo(network.config.CNIVersion, statusMinVersion)
+	if err != nil {
+		return NetworkStatus{State: NetworkNotReady, Err: err}
+	}
+
+	if !supported {
+		return NetworkStatus{State: NetworkStatusUnsupported}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, plugin.statusTimeout)
+	defer cancel()
+
+	if err := network.getNetworkStatus(ctx, plugin.cniConfig); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %v: %w", plugin.statusTimeout, err)
+		}
+
+		return NetworkStatus{State: NetworkNotReady, Err: err}
+	}
+
+	return NetworkStatus{State: NetworkReady}
+}
+
+// StatusAll runs the CNI STATUS verb concurrently against every loaded
+// network and returns their status by network name. Each network has to
+// answer within the status timeout, see WithStatusTimeout. Networks whose
+// cniVersion predates STATUS are reported as NetworkStatusUnsupported.
+func (plugin *cniNetworkPlugin) StatusAll(ctx context.Context) map[string]NetworkStatus {
+	plugin.RLock()
+
+	networks := make([]*cniNetwork, 0, len(plugin.networks))
+	for _, network := range plugin.networks {
+		networks = append(networks, network)
+	}
+
+	plugin.RUnlock()
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+
+	statuses := make(map[string]NetworkStatus, len(networks))
+
+	for _, network := range networks {
+		wg.Go(func() {
+			status := plugin.networkStatus(ctx, network)
+
+			mu.Lock()
+			statuses[network.name] = status
+			mu.Unlock()
+		})
+	}
+
+	wg.Wait()
+
+	return statuses
+}
@@ -0,0 +1,92 @@
+package ocicni
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isAllowedSysctl reports whether key is a network namespaced sysctl which
+// may be set for a pod.
+func isAllowedSysctl(key string) bool {
+	switch key {
+	case "net.core.somaxconn",
+		"net.ipv4.ip_forward",
+		"net.ipv4.ip_local_port_range",
+		"net.ipv4.ip_local_reserved_ports",
+		"net.ipv4.ip_unprivileged_port_start",
+		"net.ipv4.ping_group_range",
+		"net.ipv4.tcp_fin_timeout",
+		"net.ipv4.tcp_keepalive_intvl",
+		"net.ipv4.tcp_keepalive_probes",
+		"net.ipv4.tcp_keepalive_time",
+		"net.ipv4.tcp_rmem",
+		"net.ipv4.tcp_syncookies",
+		"net.ipv4.tcp_tw_reuse",
+		"net.ipv4.tcp_wmem",
+		"net.ipv6.ip_nonlocal_bind":
+		return true
+	}
+
+	return isInterfaceSysctl(key)
+}
+
+// interfaceSysctlIndex is the index of the interface name in the parts of
+// per interface sysctls like "net.ipv4.conf.eth0.forwarding".
+const interfaceSysctlIndex = 3
+
+// isInterfaceSysctl reports whether key is a per interface sysctl.
+func isInterfaceSysctl(key string) bool {
+	for _, prefix := range []string{"net.ipv4.conf.", "net.ipv4.neigh.", "net.ipv6.conf.", "net.ipv6.neigh."} {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateSysctls checks that all sysctls are allowed and well formed.
+// Interface names may contain dots, which are written as slashes like in
+// "net.ipv4.conf.eth0/100.rp_filter".
+func validateSysctls(sysctls map[string]string) error {
+	for key, value := range sysctls {
+		if !isAllowedSysctl(key) {
+			return fmt.Errorf("sysctl %q is not allowed", key)
+		}
+
+		for i, part := range strings.Split(key, ".") {
+			if i == interfaceSysctlIndex && isInterfaceSysctl(key) {
+				part = strings.ReplaceAll(part, "/", ".")
+				if part == "." || part == ".." {
+					return fmt.Errorf("invalid sysctl %q", key)
+				}
+			}
+
+			if part == "" || strings.Contains(part, "/") {
+				return fmt.Errorf("invalid sysctl %q", key)
+			}
+		}
+
+		if value == "" || strings.ContainsAny(value, "\n") {
+			return fmt.Errorf("invalid value %q for sysctl %q", value, key)
+		}
+	}
+
+	return nil
+}
+
+// sysctlPath returns the path of a sysctl relative to /proc/sys, swapping the
+// dots which separate its parts and the slashes which stand for dots in
+// interface names.
+func sysctlPath(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '/':
+			return '.'
+		}
+
+		return r
+	}, key)
+}
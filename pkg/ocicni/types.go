@@ -44,11 +44,25 @@ type IpRange struct {
 type RuntimeConfig struct {
 	// IP is a static IP to be specified in the network. Can only be used
 	// with the hostlocal IP allocator. If left unset, an IP will be
-	// dynamically allocated.
+	// dynamically allocated. Use IPs to request more than one address.
 	IP string
+	// IPs are static IPs to be specified in the network, at most one per
+	// IP family, optionally with a prefix length like "10.0.0.5/24". They
+	// are passed with the "ips" capability if the network declares it, and
+	// as IP in CNI_ARGS otherwise. IP and IPs are mutually exclusive.
+	IPs []string
 	// MAC is a static MAC address to be assigned to the network interface.
-	// If left unset, a MAC will be dynamically allocated.
+	// If left unset, a MAC will be dynamically allocated. It is passed
+	// with the "mac" capability if the network declares it, and as MAC in
+	// CNI_ARGS otherwise.
 	MAC string
+	// DeviceID is the PCI address of the device allocated to the network,
+	// like "0000:03:00.1", passed with the "deviceID" capability.
+	DeviceID string
+	// InfinibandGUID is the InfiniBand GUID of the network interface, like
+	// "c2:11:22:33:44:55:66:77", passed with the "infinibandGUID"
+	// capability.
+	InfinibandGUID string
 	// PortMappings is the port mapping of the sandbox.
 	PortMappings []PortMapping
 	// Bandwidth is the bandwidth limiting of the pod
@@ -60,6 +74,23 @@ type RuntimeConfig struct {
 	CgroupPath string
 	// PodAnnotations are the annotations of the pod.
 	PodAnnotations *map[string]string `json:"io.kubernetes.cri.pod-annotations,omitempty"` //nolint:tagliatelle // Kubernetes API format
+	// DNS is the DNS configuration of the pod
+	DNS *DNSConfig
+	// CapabilityArgs are additional capability arguments, passed to the
+	// plugins which declare the capability. Keys of capabilities which are
+	// set from the other fields of RuntimeConfig must not be used.
+	CapabilityArgs map[string]any
+}
+
+// DNSConfig maps to the standard CNI dns Capability
+// see: https://github.com/containernetworking/cni/blob/master/CONVENTIONS.md
+type DNSConfig struct {
+	// Servers is a list of DNS servers, by IP address
+	Servers []string
+	// Searches is a list of DNS search domains
+	Searches []string
+	// Options is a list of DNS options
+	Options []string
 }
 
 // BandwidthConfig maps to the standard CNI bandwidth Capability
@@ -94,13 +125,36 @@ type PodNetwork struct {
 
 	// NetworkConfig is configuration specific to a single CNI network.
 	// It is optional, and can be omitted for some or all specified networks
-	// without issue.
+	// without issue. It is only used for attachments without a runtime
+	// config in AttachmentConfig. Every key must be the name of a network
+	// the pod is attached to.
 	RuntimeConfig map[string]RuntimeConfig
 
+	// AttachmentConfig is optional configuration specific to a single
+	// network attachment, keyed by the network and interface name of the
+	// attachment. It allows attaching the same network more than once with
+	// different configurations. Every key must match an attachment of the
+	// pod, including synthesized interface names.
+	AttachmentConfig map[NetAttachmentKey]NetAttachmentConfig
+
 	// Aliases are network-scoped names for resolving a container
 	// by name. The key value is the network name and the value is
 	// a string slice of aliases
 	Aliases map[string][]string
+
+	// Args are optional additional CNI_ARGS key/value pairs which are
+	// passed to the plugins of all attachments of the pod. Keys and values
+	// must not contain ';' or '=', and must not repeat a key set by ocicni
+	// or by the attachment.
+	Args [][2]string
+
+	// Sysctls are network namespaced sysctls which are set in the network
+	// namespace of the pod before it is added to its first network. Keys
+	// use the dotted form, like "net.ipv4.ip_unprivileged_port_start", with
+	// dots in interface names written as slashes, like
+	// "net.ipv4.conf.eth0/100.rp_filter". They must be allowed by the
+	// sysctl allowlist.
+	Sysctls map[string]string
 }
 
 // NetAttachment describes a container network attachment.
@@ -110,6 +164,33 @@ type NetAttachment struct {
 	Name string
 	// Ifname contains the optional interface name of the attachment
 	Ifname string
+	// Primary marks the attachment carrying the primary IPs of the pod.
+	// At most one attachment of a pod may be marked as primary. If none
+	// is, the attachment to the default network is the primary one, or
+	// the first attachment if the pod is not attached to the default
+	// network.
+	Primary bool
+}
+
+// NetAttachmentKey identifies a network attachment of a pod.
+type NetAttachmentKey struct {
+	// Name is the name of the CNI network of the attachment
+	Name string
+	// Ifname is the interface name of the attachment
+	Ifname string
+}
+
+// NetAttachmentConfig is configuration specific to a single network
+// attachment.
+type NetAttachmentConfig struct {
+	// RuntimeConfig is the optional configuration of the attachment. If
+	// set, it is used instead of the PodNetwork.RuntimeConfig entry of the
+	// network.
+	RuntimeConfig *RuntimeConfig
+	// Args are optional additional CNI_ARGS key/value pairs which are only
+	// passed to the plugins of the attachment. They are validated like
+	// PodNetwork.Args.
+	Args [][2]string
 }
 
 // NetResult contains the result the network attachment operation.
@@ -165,3 +246,68 @@ type CNIPlugin interface {
 	// Shutdown terminates all driver operations
 	Shutdown() error
 }
+
+// The following interfaces extend CNIPlugin with optional functionality.
+// The plugins returned by the InitCNI functions implement all of them, other
+// implementations may not, so callers type-assert the plugin to use them.
+
+// NetworkAttacher is implemented by plugins which attach networks to and
+// detach networks from pods which have already been set up.
+type NetworkAttacher interface {
+	// AttachNetwork attaches a single additional network to a pod which
+	// has already been set up
+	AttachNetwork(ctx context.Context, network PodNetwork, attachment NetAttachment, runtimeConfig RuntimeConfig) (*NetResult, error)
+
+	// DetachNetwork detaches a single network from a pod, keeping its
+	// other attachments
+	DetachNetwork(ctx context.Context, network PodNetwork, attachment NetAttachment) error
+}
+
+// DryRunner is implemented by plugins which report the plugin invocations
+// of pod operations without executing them.
+type DryRunner interface {
+	// SetUpPodDryRun returns the plugin invocations SetUpPod would make,
+	// without executing any plugin
+	SetUpPodDryRun(ctx context.Context, network PodNetwork) ([]DryRunResult, error)
+
+	// TearDownPodDryRun returns the plugin invocations TearDownPod would
+	// make, without executing any plugin
+	TearDownPodDryRun(ctx context.Context, network PodNetwork) ([]DryRunResult, error)
+}
+
+// HostPortLister is implemented by plugins which track the host ports of
+// their pods.
+type HostPortLister interface {
+	// HostPorts returns the host ports reserved by the port mappings of
+	// all pods set up by the plugin
+	HostPorts() []HostPortReservation
+}
+
+// LiveStatusReader is implemented by plugins which read the network status
+// of pods from their network namespace.
+type LiveStatusReader interface {
+	// GetPodNetworkLiveStatus reads the current addresses, routes and link
+	// state of the pod interfaces from its network namespace and reports
+	// their discrepancies with the cached CNI results
+	GetPodNetworkLiveStatus(ctx context.Context, network PodNetwork) ([]LiveNetResult, error)
+}
+
+// NetworkStatusReporter is implemented by plugins which report the
+// readiness of each of their networks.
+type NetworkStatusReporter interface {
+	// StatusAll runs STATUS against every loaded network and returns
+	// their readiness by network name
+	StatusAll(ctx context.Context) map[string]NetworkStatus
+}
+
+// Debugger is implemented by plugins which report their in-flight pod
+// operations.
+type Debugger interface {
+	// InFlight returns all pods which currently hold or wait for their
+	// pod lock, with the operation they are running
+	InFlight() []InFlightOperation
+
+	// Debug returns a snapshot of the in-flight pod operations and of the
+	// GC lock
+	Debug() DebugInfo
+}
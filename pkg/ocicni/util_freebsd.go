@@ -8,72 +8,104 @@ import (
 	"fmt"
 	"net"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 )
 
-type nsManager struct{}
+// loopbackPluginSupported is whether the loopback interface can be set up by
+// the CNI loopback plugin. There is none for FreeBSD, whose loopback
+// interface is lo0.
+const loopbackPluginSupported = false
 
-func (nsm *nsManager) init() error {
-	return nil
-}
-
-func getContainerDetails(ctx context.Context, nsm *nsManager, netnsJailName, interfaceName, addrType string) (*net.IPNet, *net.HardwareAddr, error) {
-	// Try to retrieve ip inside container network namespace
-	if addrType == "-4" {
-		addrType = "inet"
-	} else {
-		addrType = "inet6"
-	}
+// getLiveInterfaceStatus reads the status of an interface in the vnet jail
+// netnsJailName. Routes are not read.
+func getLiveInterfaceStatus(ctx context.Context, netnsJailName, interfaceName string) (*LiveInterfaceStatus, error) {
 	output, err := exec.CommandContext(ctx,
 		"ifconfig", "-j", netnsJailName,
 		"-f", "inet:cidr,inet6:cidr",
-		interfaceName,
-		addrType).CombinedOutput()
+		interfaceName).CombinedOutput()
 	if err != nil {
-		return nil, nil, fmt.Errorf("unexpected command output %s with error: %w", output, err)
+		return nil, fmt.Errorf("unexpected command output %s with error: %w", output, err)
 	}
 
 	lines := strings.Split(string(output), "\n")
-	if len(lines) < 3 {
-		return nil, nil, fmt.Errorf("unexpected command output %s", output)
-	}
-	fields := strings.Fields(strings.TrimSpace(lines[2]))
-	if len(fields) < 2 {
-		return nil, nil, fmt.Errorf("unexpected address output %s ", lines[0])
-	}
-	ip, ipNet, err := net.ParseCIDR(fields[1])
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse ip from output %s due to %w", output, err)
-	}
-	if ip.To4() == nil {
-		ipNet.IP = ip
-	} else {
-		ipNet.IP = ip.To4()
-	}
 
-	// Try to retrieve MAC inside container network namespace
-	output, err = exec.CommandContext(ctx,
-		"ifconfig", "-j", netnsJailName, "-f", "inet:cidr,inet6:cidr",
-		interfaceName,
-		"ether").CombinedOutput()
-	if err != nil {
-		return nil, nil, fmt.Errorf("unexpected ifconfig command output %s with error: %w", output, err)
+	// The first line is like "eth0: flags=8863<UP,...> metric 0 mtu 1500"
+	header := strings.Fields(lines[0])
+	if len(header) < 2 || !strings.HasPrefix(header[1], "flags=") {
+		return nil, fmt.Errorf("unexpected ifconfig output %s", output)
 	}
 
-	lines = strings.Split(string(output), "\n")
-	if len(lines) < 3 {
-		return nil, nil, fmt.Errorf("unexpected ifconfig command output %s", output)
+	status := &LiveInterfaceStatus{Name: interfaceName, OperState: "unknown"}
+	if _, flags, ok := strings.Cut(header[1], "<"); ok {
+		flagList := strings.Split(strings.TrimSuffix(flags, ">"), ",")
+		status.Up = slices.Contains(flagList, "UP")
+		status.Carrier = slices.Contains(flagList, "RUNNING")
 	}
-	fields = strings.Fields(strings.TrimSpace(lines[2]))
-	if len(fields) < 2 {
-		return nil, nil, fmt.Errorf("unexpected ether output %s ", lines[0])
+
+	for i := 2; i+1 < len(header); i++ {
+		if header[i] == "mtu" {
+			if status.MTU, err = strconv.Atoi(header[i+1]); err != nil {
+				return nil, fmt.Errorf("failed to parse MTU from output %s due to %w", output, err)
+			}
+		}
 	}
-	mac, err := net.ParseMAC(fields[1])
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse MAC from output %s due to %w", output, err)
+
+	var ipv6s []*net.IPNet
+
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "ether":
+			mac, err := net.ParseMAC(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse MAC from output %s due to %w", output, err)
+			}
+
+			status.MAC = mac.String()
+		case "status:":
+			// Like "status: active" or "status: no carrier"
+			status.Carrier = fields[1] == "active"
+			if status.Carrier {
+				status.OperState = "up"
+			} else {
+				status.OperState = "down"
+			}
+		case "inet", "inet6":
+			// Link-local IPv6 addresses have a zone, like "fe80::1%eth0/64"
+			address := fields[1]
+			if addr, zone, ok := strings.Cut(address, "%"); ok {
+				_, prefix, _ := strings.Cut(zone, "/")
+				address = addr + "/" + prefix
+			}
+
+			ip, ipNet, err := net.ParseCIDR(address)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse ip from output %s due to %w", output, err)
+			}
+
+			if !ip.IsGlobalUnicast() {
+				continue
+			}
+
+			if ip.To4() == nil {
+				ipNet.IP = ip
+				ipv6s = append(ipv6s, ipNet)
+			} else {
+				ipNet.IP = ip.To4()
+				status.IPs = append(status.IPs, ipNet)
+			}
+		}
 	}
 
-	return ipNet, &mac, nil
+	status.IPs = append(status.IPs, ipv6s...)
+
+	return status, nil
 }
 
 func bringUpLoopback(netns string) error {
@@ -86,3 +118,11 @@ func bringUpLoopback(netns string) error {
 func checkLoopback(netns string) error {
 	return nil
 }
+
+func applySysctls(netnsJailName string, sysctls map[string]string) error {
+	if len(sysctls) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("sysctls are not supported for jail %s", netnsJailName)
+}
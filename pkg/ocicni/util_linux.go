@@ -7,84 +7,99 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"os/exec"
-	"strings"
+	"os"
+	"path/filepath"
+	"slices"
 
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const (
-	defaultNamespaceEnterCommandName = "nsenter"
-	minIPAddrFields                  = 4
-	minLinkOutputLines               = 2
-	minLinkFields                    = 4
+	// sysctlDir is the directory below which sysctls are exposed.
+	sysctlDir = "/proc/sys"
+
+	// loopbackPluginSupported is whether the loopback interface can be set
+	// up by the CNI loopback plugin.
+	loopbackPluginSupported = true
 )
 
-type nsManager struct {
-	nsenterPath string
-}
+// getLiveInterfaceStatus reads the status of an interface in the network
+// namespace at netnsPath.
+func getLiveInterfaceStatus(_ context.Context, netnsPath, interfaceName string) (*LiveInterfaceStatus, error) {
+	status := &LiveInterfaceStatus{Name: interfaceName, Routes: []LiveRoute{}}
 
-func (nsm *nsManager) init() error {
-	var err error
+	if err := ns.WithNetNSPath(netnsPath, func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(interfaceName)
+		if err != nil {
+			return err
+		}
 
-	nsm.nsenterPath, err = exec.LookPath(defaultNamespaceEnterCommandName)
+		attrs := link.Attrs()
+		status.MAC = attrs.HardwareAddr.String()
+		status.MTU = attrs.MTU
+		status.OperState = attrs.OperState.String()
+		status.Up = attrs.Flags&net.FlagUp == net.FlagUp
+		status.Carrier = attrs.RawFlags&unix.IFF_LOWER_UP != 0
+
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			addrs, err := netlink.AddrList(link, family)
+			if err != nil {
+				return err
+			}
 
-	return err
-}
+			for i := range addrs {
+				if addrs[i].Scope != int(netlink.SCOPE_UNIVERSE) {
+					continue
+				}
 
-func getContainerDetails(ctx context.Context, nsm *nsManager, netnsPath, interfaceName, addrType string) (*net.IPNet, *net.HardwareAddr, error) {
-	// Try to retrieve ip inside container network namespace
-	output, err := exec.CommandContext(ctx, nsm.nsenterPath, "--net="+netnsPath, "-F", "--",
-		"ip", "-o", addrType, "addr", "show", "dev", interfaceName, "scope", "global").CombinedOutput()
-	if err != nil {
-		return nil, nil, fmt.Errorf("unexpected command output %s with error: %w", output, err)
-	}
+				ipNet := *addrs[i].IPNet
+				if ip4 := ipNet.IP.To4(); ip4 != nil {
+					ipNet.IP = ip4
+				}
 
-	lines := strings.Split(string(output), "\n")
-	if len(lines) < 1 {
-		return nil, nil, fmt.Errorf("unexpected command output %s", output)
-	}
+				status.IPs = append(status.IPs, &ipNet)
+			}
 
-	fields := strings.Fields(lines[0])
-	if len(fields) < minIPAddrFields {
-		return nil, nil, fmt.Errorf("unexpected address output %s ", lines[0])
-	}
+			routes, err := netlink.RouteList(link, family)
+			if err != nil {
+				return err
+			}
 
-	ip, ipNet, err := net.ParseCIDR(fields[3])
-	if err != nil {
-		return nil, nil, fmt.Errorf("CNI failed to parse ip from output %s due to %w", output, err)
-	}
+			for i := range routes {
+				dst := routes[i].Dst
+				if dst == nil || isDefaultRoute(dst) {
+					dst = defaultRouteDst(family)
+				}
 
-	if ip.To4() == nil {
-		ipNet.IP = ip
-	} else {
-		ipNet.IP = ip.To4()
-	}
+				if dst.IP.IsLinkLocalUnicast() || dst.IP.IsMulticast() {
+					continue
+				}
 
-	// Try to retrieve MAC inside container network namespace
-	output, err = exec.CommandContext(ctx, nsm.nsenterPath, "--net="+netnsPath, "-F", "--",
-		"ip", "link", "show", "dev", interfaceName).CombinedOutput()
-	if err != nil {
-		return nil, nil, fmt.Errorf("unexpected 'ip link' command output %s with error: %w", output, err)
-	}
+				status.Routes = append(status.Routes, LiveRoute{Dst: *dst, GW: routes[i].Gw})
 
-	lines = strings.Split(string(output), "\n")
-	if len(lines) < minLinkOutputLines {
-		return nil, nil, fmt.Errorf("unexpected 'ip link' command output %s", output)
-	}
+				if isDefaultRoute(dst) && routes[i].Gw != nil {
+					status.Gateways = append(status.Gateways, routes[i].Gw)
+				}
+			}
+		}
 
-	fields = strings.Fields(lines[1])
-	if len(fields) < minLinkFields {
-		return nil, nil, fmt.Errorf("unexpected link output %s ", lines[1])
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get status of interface %s in %s: %w", interfaceName, netnsPath, err)
 	}
 
-	mac, err := net.ParseMAC(fields[1])
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to parse MAC from output %s due to %w", output, err)
+	return status, nil
+}
+
+// defaultRouteDst returns the destination of default routes of a family.
+func defaultRouteDst(family int) *net.IPNet {
+	if family == netlink.FAMILY_V4 {
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, net.IPv4len*8)}
 	}
 
-	return ipNet, &mac, nil
+	return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, net.IPv6len*8)}
 }
 
 func bringUpLoopback(netns string) error {
@@ -153,3 +168,29 @@ func checkLoopback(netns string) error {
 
 	return nil
 }
+
+// applySysctls sets sysctls in the network namespace, in the order of their
+// keys.
+func applySysctls(netns string, sysctls map[string]string) error {
+	if len(sysctls) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(sysctls))
+	for key := range sysctls {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	return ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+		for _, key := range keys {
+			path := filepath.Join(sysctlDir, sysctlPath(key))
+			if err := os.WriteFile(path, []byte(sysctls[key]), 0o644); err != nil {
+				return fmt.Errorf("failed to set sysctl %q to %q: %w", key, sysctls[key], err)
+			}
+		}
+
+		return nil
+	})
+}
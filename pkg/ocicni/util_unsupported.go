@@ -6,20 +6,16 @@ package ocicni
 import (
 	"context"
 	"errors"
-	"net"
 )
 
-type nsManager struct {
-}
-
 var errUnsupportedPlatform = errors.New("unsupported platform")
 
-func (nsm *nsManager) init() error {
-	return nil
-}
+// loopbackPluginSupported is whether the loopback interface can be set up by
+// the CNI loopback plugin.
+const loopbackPluginSupported = false
 
-func getContainerDetails(_ context.Context, nsm *nsManager, netnsPath, interfaceName, addrType string) (*net.IPNet, *net.HardwareAddr, error) {
-	return nil, nil, errUnsupportedPlatform
+func getLiveInterfaceStatus(_ context.Context, netnsPath, interfaceName string) (*LiveInterfaceStatus, error) {
+	return nil, errUnsupportedPlatform
 }
 
 func bringUpLoopback(netns string) error {
@@ -30,3 +26,11 @@ func checkLoopback(netns string) error {
 	return errUnsupportedPlatform
 
 }
+
+func applySysctls(netns string, sysctls map[string]string) error {
+	if len(sysctls) == 0 {
+		return nil
+	}
+
+	return errUnsupportedPlatform
+}
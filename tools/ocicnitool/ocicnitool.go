@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -46,8 +48,34 @@ func printSandboxResults(results []ocicni.NetResult) {
 	}
 }
 
+func printLiveResults(results []ocicni.LiveNetResult) {
+	for _, r := range results {
+		intf := r.Interface
+		fmt.Fprintf(os.Stdout, "Network %s: %s %s mtu %d state %s carrier %t\n",
+			r.Name, intf.Name, intf.MAC, intf.MTU, intf.OperState, intf.Carrier)
+
+		for _, ip := range intf.IPs {
+			fmt.Fprintf(os.Stdout, "IP: %s\n", ip.String())
+		}
+
+		for _, route := range intf.Routes {
+			if route.GW != nil {
+				fmt.Fprintf(os.Stdout, "Route: %s via %s\n", route.Dst.String(), route.GW.String())
+			} else {
+				fmt.Fprintf(os.Stdout, "Route: %s\n", route.Dst.String())
+			}
+		}
+
+		for _, discrepancy := range r.Discrepancies {
+			fmt.Fprintf(os.Stdout, "Discrepancy: %s\n", discrepancy)
+		}
+	}
+}
+
 func main() {
 	networksStr := flag.String("networks", "", "comma-separated list of CNI network names (optional)")
+	live := flag.Bool("live", false, "read the status from the network namespace instead of the CNI cache (status only)")
+	fileLock := flag.Bool("file-lock", false, "lock pod operations against other processes sharing the CNI cache directory")
 
 	flag.Parse()
 
@@ -63,9 +91,9 @@ func main() {
 		exe := filepath.Base(os.Args[0])
 
 		fmt.Fprintf(os.Stderr, "%s: Add or remove CNI networks from a network namespace\n", exe)
-		fmt.Fprintf(os.Stderr, "  %s [-networks name[,name...]] %s    <pod_namespace> <pod_name> <pod_id> <netns>\n", exe, CmdAdd)
-		fmt.Fprintf(os.Stderr, "  %s [-networks name[,name...]] %s <pod_namespace> <pod_name> <pod_id> <netns>\n", exe, CmdStatus)
-		fmt.Fprintf(os.Stderr, "  %s [-networks name[,name...]] %s   <pod_namespace> <pod_name> <pod_id> <netns>\n", exe, CmdDel)
+		fmt.Fprintf(os.Stderr, "  %s [-networks name[,name...]] [-file-lock] %s    <pod_namespace> <pod_name> <pod_id> <netns>\n", exe, CmdAdd)
+		fmt.Fprintf(os.Stderr, "  %s [-networks name[,name...]] [-file-lock] [-live] %s <pod_namespace> <pod_name> <pod_id> <netns>\n", exe, CmdStatus)
+		fmt.Fprintf(os.Stderr, "  %s [-networks name[,name...]] [-file-lock] %s   <pod_namespace> <pod_name> <pod_id> <netns>\n", exe, CmdDel)
 	}
 
 	if len(flag.Args()) < minRequiredArgs {
@@ -83,7 +111,12 @@ func main() {
 		bindir = ocicni.DefaultBinDir
 	}
 
-	plugin, err := ocicni.InitCNI("", confdir, bindir)
+	opts := []ocicni.Option{}
+	if *fileLock {
+		opts = append(opts, ocicni.WithFileLocking())
+	}
+
+	plugin, err := ocicni.InitCNIWithOptions("", confdir, "", []string{bindir}, opts...)
 	if err != nil {
 		exit(err)
 	}
@@ -110,6 +143,20 @@ func main() {
 
 		exit(err)
 	case CmdStatus:
+		if *live {
+			reader, ok := plugin.(ocicni.LiveStatusReader)
+			if !ok {
+				exit(errors.New("the CNI plugin does not support reading the live status"))
+			}
+
+			results, err := reader.GetPodNetworkLiveStatus(context.Background(), podNetwork)
+			if err == nil {
+				printLiveResults(results)
+			}
+
+			exit(err)
+		}
+
 		results, err := plugin.GetPodNetworkStatus(podNetwork)
 		if err == nil {
 			printSandboxResults(results)